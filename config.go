@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"github.com/beyondblog/llm-api-gateway/proxy"
+	"github.com/beyondblog/llm-api-gateway/utils"
+	"time"
+)
+
+// Config is the gateway config file, every model gets its own pool of backends
+type Config struct {
+	Models []ModelConfig `json:"models" yaml:"models"`
+	// Budget caps the spend of the vast.ai instances of all models together
+	Budget *provider.BudgetConfig `json:"budget" yaml:"budget"`
+}
+
+// ModelConfig describes where the backends of one model come from
+type ModelConfig struct {
+	// Model is the huggingface repository rented on vast.ai, leave empty to serve only static backends
+	Model            string         `json:"model" yaml:"model"`
+	Branch           string         `json:"branch" yaml:"branch"`
+	Label            string         `json:"label" yaml:"label"`
+	Template         string         `json:"template" yaml:"template"`
+	UnhealthyTimeout utils.Duration `json:"unhealthy_timeout" yaml:"unhealthy_timeout"`
+	StaticBackends   string         `json:"static_backends" yaml:"static_backends"`
+	ScalingPolicy    string         `json:"scaling_policy" yaml:"scaling_policy"`
+	Aliases          []string       `json:"aliases" yaml:"aliases"`
+	// BackfillMinReplicas is the number of instances kept with on-demand ones when interruptible ones are preempted
+	BackfillMinReplicas int `json:"backfill_min_replicas" yaml:"backfill_min_replicas"`
+	// Autoscaling sizes the replicas to the load, the replicas are left alone when unset
+	Autoscaling *AutoscalingConfig `json:"autoscaling" yaml:"autoscaling"`
+}
+
+// AutoscalingConfig bounds and tunes the autoscaler of a model, see proxy.AutoscalerConfig
+type AutoscalingConfig struct {
+	MinReplicas       int            `json:"min_replicas" yaml:"min_replicas"`
+	MaxReplicas       int            `json:"max_replicas" yaml:"max_replicas"`
+	Interval          utils.Duration `json:"interval" yaml:"interval"`
+	TargetUtilization float64        `json:"target_utilization" yaml:"target_utilization"`
+	MaxQueueWait      utils.Duration `json:"max_queue_wait" yaml:"max_queue_wait"`
+	ScaleUpCooldown   utils.Duration `json:"scale_up_cooldown" yaml:"scale_up_cooldown"`
+	ScaleDownCooldown utils.Duration `json:"scale_down_cooldown" yaml:"scale_down_cooldown"`
+	ScaleToZeroAfter  utils.Duration `json:"scale_to_zero_after" yaml:"scale_to_zero_after"`
+	ColdStartTimeout  utils.Duration `json:"cold_start_timeout" yaml:"cold_start_timeout"`
+}
+
+func (a AutoscalingConfig) autoscalerConfig() proxy.AutoscalerConfig {
+	return proxy.AutoscalerConfig{
+		MinReplicas:       a.MinReplicas,
+		MaxReplicas:       a.MaxReplicas,
+		Interval:          time.Duration(a.Interval),
+		TargetUtilization: a.TargetUtilization,
+		MaxQueueWait:      time.Duration(a.MaxQueueWait),
+		ScaleUpCooldown:   time.Duration(a.ScaleUpCooldown),
+		ScaleDownCooldown: time.Duration(a.ScaleDownCooldown),
+		ScaleToZeroAfter:  time.Duration(a.ScaleToZeroAfter),
+		ColdStartTimeout:  time.Duration(a.ColdStartTimeout),
+	}
+}
+
+// newProvider builds the provider of a model, merging static and vast.ai backends when both are set
+func (m ModelConfig) newProvider(vastAIAPIKey string, budget *provider.Budget) (provider.LLMProvider, error) {
+	var members []provider.CompositeMember
+	if m.StaticBackends != "" {
+		staticProvider, err := provider.NewStaticProvider(m.StaticBackends)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, provider.CompositeMember{Name: "static", Provider: staticProvider})
+	}
+	if m.Model != "" {
+		vastAIProvider, err := m.newVastAIProvider(vastAIAPIKey)
+		if err != nil {
+			return nil, err
+		}
+		vastAIProvider.SetBudget(budget)
+		members = append(members, provider.CompositeMember{Name: "vastai", Provider: vastAIProvider})
+	}
+
+	switch len(members) {
+	case 0:
+		return nil, fmt.Errorf("model config needs a model or static_backends")
+	case 1:
+		return members[0].Provider, nil
+	}
+	policy := provider.ScalingPolicyFill
+	if m.ScalingPolicy != "" {
+		policy = provider.ScalingPolicy(m.ScalingPolicy)
+	}
+	return provider.NewCompositeProvider(policy, members...)
+}
+
+// newVastAIProvider builds the vast.ai provider renting instances of the model
+func (m ModelConfig) newVastAIProvider(vastAIAPIKey string) (*provider.VastAIProvider, error) {
+	vastAIProvider := provider.NewVastAIProvider(vastAIAPIKey, m.Model, m.Branch, m.Label)
+	if m.Template != "" {
+		template, err := provider.LoadInstanceTemplate(m.Template)
+		if err != nil {
+			return nil, err
+		}
+		vastAIProvider.SetInstanceTemplate(template)
+	}
+	vastAIProvider.SetUnhealthyTimeout(time.Duration(m.UnhealthyTimeout))
+	vastAIProvider.SetBackfill(m.BackfillMinReplicas)
+	return vastAIProvider, nil
+}
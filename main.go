@@ -1,22 +1,245 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/beyondblog/llm-api-gateway/provider"
 	"github.com/beyondblog/llm-api-gateway/proxy"
+	"github.com/beyondblog/llm-api-gateway/utils"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
+	configFile   = flag.String("config", "", "gateway config file (yaml or json) with one entry per model, replaces the model flags")
 	vastAIAPIKey = flag.String("vastai_api_key", "", "vast.ai api key")
 	port         = flag.Int("port", 8080, "Port to serve")
 	model        = flag.String("model", "gpt2", "model name")
 	branch       = flag.String("branch", "main", "branch name")
 	label        = flag.String("label", "", "label")
+	templateFile = flag.String("template", "", "vast.ai instance template file (yaml or json)")
+	unhealthy    = flag.Duration("unhealthy_timeout", 0, "destroy instances failing the health check for longer than this, 0 disables")
+	backfillMin  = flag.Int("backfill_min_replicas", 0, "instances kept by renting on-demand ones when interruptible instances are preempted")
+	staticFile   = flag.String("static_backends", "", "self-hosted backends file (yaml or json)")
+	policy       = flag.String("scaling_policy", "fill", "how replicas are split between self-hosted backends and vast.ai: fill or spread")
+	aliases      = flag.String("aliases", "", "comma separated model names routed to the model, e.g. gpt-3.5-turbo")
+	apiKeys      = flag.String("api_keys", "", "API key file (yaml or json), clients must send one of the keys when set")
+	usageDB      = flag.String("usage_db", "usage.db", "token usage database file, empty disables usage accounting")
+	adminToken   = flag.String("admin_token", "", "bearer token of the /admin api, empty disables it")
+	balancer     = flag.String("balancer", proxy.BalancerRoundRobin, "load balancing strategy: round_robin or least_outstanding")
+	concurrency  = flag.Int("max_concurrency", 0, "concurrent requests per backend, 0 derives it from the GPU type, -1 is unlimited")
+	gpuLimits    = flag.String("gpu_concurrency", "", "comma separated GPU=limit pairs overriding the built-in table, e.g. \"RTX 4090=6,A100=16\"")
+	queueSize    = flag.Int("queue_size", 100, "requests waiting at the gateway for a free backend, per model")
+	queueTimeout = flag.Duration("queue_timeout", 30*time.Second, "how long a request waits for a free backend")
+	streamIdle   = flag.Duration("stream_idle_timeout", time.Minute, "end a streamed response when the backend sends nothing for this long, 0 disables")
+	headerWait   = flag.Duration("response_header_timeout", 10*time.Minute, "how long to wait for a backend to start responding")
+	breakerLimit = flag.Int("breaker_threshold", 5, "consecutive failed requests that take a backend out of rotation, 0 disables the circuit breaker")
+	breakerWait  = flag.Duration("breaker_cooldown", 10*time.Second, "how long a backend stays out of rotation before a probe request")
+	minReplicas  = flag.Int("min_replicas", 0, "fewest replicas the autoscaler keeps")
+	maxReplicas  = flag.Int("max_replicas", 0, "most replicas the autoscaler starts, 0 disables autoscaling")
+	scaleEvery   = flag.Duration("autoscale_interval", 30*time.Second, "how often the autoscaler evaluates the load")
+	targetUtil   = flag.Float64("target_utilization", 0.7, "share of the backend concurrency the autoscaler sizes the replicas for")
+	maxWait      = flag.Duration("max_queue_wait", 5*time.Second, "queue wait that makes the autoscaler add a replica")
+	upCooldown   = flag.Duration("scale_up_cooldown", 3*time.Minute, "wait after scaling before scaling up again")
+	downCooldown = flag.Duration("scale_down_cooldown", 10*time.Minute, "wait after scaling before scaling down")
+	idleToZero   = flag.Duration("scale_to_zero_after", 0, "scale to zero replicas after no request for this long, 0 disables")
+	coldStart    = flag.Duration("cold_start_timeout", 10*time.Minute, "how long a request is held while scaling up from zero")
+	healthEvery  = flag.Duration("health_check_interval", 30*time.Second, "how often backends are health checked")
+	healthWait   = flag.Duration("health_check_timeout", 10*time.Second, "timeout of a backend health check")
+	healthProbe  = flag.Bool("health_check_completion", false, "health checks also run a one token completion on the backend")
+	accessLog    = flag.String("access_log", "", "JSON access log file rotated by size, empty logs to stdout")
+	accessLogMB  = flag.Int("access_log_max_size", 100, "size in MB at which the access log file is rotated")
+	accessLogs   = flag.Int("access_log_max_backups", 5, "rotated access log files to keep")
+	spendPerHour = flag.Float64("max_spend_per_hour", 0, "$/hr all running vast.ai instances may cost together, 0 is no limit")
+	spendPerDay  = flag.Float64("max_spend_per_day", 0, "$ the vast.ai instances may cost per day (UTC), 0 is no limit")
+	spendPerMon  = flag.Float64("max_spend_per_month", 0, "$ the vast.ai instances may cost per month (UTC), 0 is no limit")
+	budgetState  = flag.String("budget_state", "budget.json", "file keeping the daily and monthly spend across restarts")
+	dryRunOffers = flag.Int("dry_run_offers", 0, "print the N best ranked vast.ai offers of every model and exit without renting")
+	otlpEndpoint = flag.String("otlp_endpoint", "", "OTLP/HTTP collector url traces are exported to, e.g. http://localhost:4318, empty disables tracing")
 )
 
 func main() {
 	flag.Parse()
-	vastAIProvider := provider.NewVastAIProvider(*vastAIAPIKey, *model, *branch, *label)
-	proxyServer := proxy.NewProxyServer(vastAIProvider)
+	var config Config
+	if *configFile != "" {
+		if err := utils.LoadConfigFile(*configFile, &config); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		modelConfig := ModelConfig{
+			Branch:              *branch,
+			Label:               *label,
+			Template:            *templateFile,
+			UnhealthyTimeout:    utils.Duration(*unhealthy),
+			BackfillMinReplicas: *backfillMin,
+			StaticBackends:      *staticFile,
+			ScalingPolicy:       *policy,
+		}
+		if *vastAIAPIKey != "" || *staticFile == "" {
+			modelConfig.Model = *model
+		}
+		if *aliases != "" {
+			modelConfig.Aliases = strings.Split(*aliases, ",")
+		}
+		if *maxReplicas > 0 {
+			modelConfig.Autoscaling = &AutoscalingConfig{
+				MinReplicas:       *minReplicas,
+				MaxReplicas:       *maxReplicas,
+				Interval:          utils.Duration(*scaleEvery),
+				TargetUtilization: *targetUtil,
+				MaxQueueWait:      utils.Duration(*maxWait),
+				ScaleUpCooldown:   utils.Duration(*upCooldown),
+				ScaleDownCooldown: utils.Duration(*downCooldown),
+				ScaleToZeroAfter:  utils.Duration(*idleToZero),
+				ColdStartTimeout:  utils.Duration(*coldStart),
+			}
+		}
+		config.Models = append(config.Models, modelConfig)
+	}
+
+	if *dryRunOffers > 0 {
+		if err := printOffers(config, *dryRunOffers); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *otlpEndpoint != "" {
+		shutdown, err := utils.SetupTracing(*otlpEndpoint, "llm-api-gateway")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = shutdown(ctx)
+		}()
+	}
+
+	if config.Budget == nil && (*spendPerHour > 0 || *spendPerDay > 0 || *spendPerMon > 0) {
+		config.Budget = &provider.BudgetConfig{
+			MaxPerHour:  *spendPerHour,
+			MaxPerDay:   *spendPerDay,
+			MaxPerMonth: *spendPerMon,
+			StateFile:   *budgetState,
+		}
+	}
+	var budget *provider.Budget
+	if config.Budget != nil {
+		b, err := provider.NewBudget(*config.Budget)
+		if err != nil {
+			log.Fatal(err)
+		}
+		budget = b
+	}
+
+	var llmProviders []provider.LLMProvider
+	for _, modelConfig := range config.Models {
+		llmProvider, err := modelConfig.newProvider(*vastAIAPIKey, budget)
+		if err != nil {
+			log.Fatal(err)
+		}
+		llmProviders = append(llmProviders, llmProvider)
+	}
+	proxyServer := proxy.NewProxyServer(llmProviders...)
+	if *apiKeys != "" {
+		keys, err := proxy.LoadKeyStore(*apiKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxyServer.SetKeyStore(keys)
+	}
+	if *usageDB != "" {
+		usageStore, err := proxy.OpenUsageStore(*usageDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer usageStore.Close()
+		proxyServer.SetUsageStore(usageStore)
+	}
+	proxyServer.SetAdminToken(*adminToken)
+	if *accessLog != "" {
+		accessLogFile := &lumberjack.Logger{
+			Filename:   *accessLog,
+			MaxSize:    *accessLogMB,
+			MaxBackups: *accessLogs,
+		}
+		defer accessLogFile.Close()
+		proxyServer.SetAccessLog(accessLogFile)
+	}
+	if err := proxyServer.SetBalancer(*balancer); err != nil {
+		log.Fatal(err)
+	}
+	byGPU, err := parseGPUConcurrency(*gpuLimits)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxyServer.SetConcurrencyLimits(*concurrency, byGPU)
+	proxyServer.SetQueue(*queueSize, *queueTimeout)
+	proxyServer.SetStreamIdleTimeout(*streamIdle)
+	proxyServer.SetResponseHeaderTimeout(*headerWait)
+	proxyServer.SetCircuitBreaker(*breakerLimit, *breakerWait)
+	proxyServer.SetHealthCheck(*healthEvery, *healthWait, *healthProbe)
+	for i, modelConfig := range config.Models {
+		for _, alias := range modelConfig.Aliases {
+			if err := proxyServer.AddAlias(strings.TrimSpace(alias), llmProviders[i].GetModel()); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if modelConfig.Autoscaling != nil {
+			err := proxyServer.SetAutoscaling(llmProviders[i].GetModel(), modelConfig.Autoscaling.autoscalerConfig())
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 	proxyServer.Run(*port)
 }
+
+// printOffers prints the top offers every vast.ai model would rent from
+func printOffers(config Config, top int) error {
+	for _, modelConfig := range config.Models {
+		if modelConfig.Model == "" {
+			continue
+		}
+		vastAIProvider, err := modelConfig.newVastAIProvider(*vastAIAPIKey)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s:\n", vastAIProvider.GetModel())
+		offers, err := vastAIProvider.SearchOffers()
+		if errors.Is(err, provider.ErrNoOffers) {
+			fmt.Printf("  %v\n", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for i, offer := range offers[:min(top, len(offers))] {
+			fmt.Printf("  %d. %s\n", i+1, offer)
+		}
+	}
+	return nil
+}
+
+// parseGPUConcurrency parses "RTX 4090=6,A100=16"
+func parseGPUConcurrency(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	if value == "" {
+		return limits, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		name, limit, ok := strings.Cut(pair, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if !ok || err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid gpu concurrency: %q", pair)
+		}
+		limits[strings.TrimSpace(name)] = n
+	}
+	return limits, nil
+}
@@ -0,0 +1,170 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrBudgetExceeded is returned when renting another instance would break the spend budget
+var ErrBudgetExceeded = errors.New("spend budget exceeded")
+
+// BudgetConfig caps what the rented instances cost, a zero cap is no limit
+type BudgetConfig struct {
+	MaxPerHour  float64 `json:"max_per_hour" yaml:"max_per_hour"`   // $/hr of all running instances
+	MaxPerDay   float64 `json:"max_per_day" yaml:"max_per_day"`     // $ spent since midnight UTC
+	MaxPerMonth float64 `json:"max_per_month" yaml:"max_per_month"` // $ spent since the first of the month UTC
+	// StateFile keeps the daily and monthly spend across restarts, empty keeps it in memory
+	StateFile string `json:"state_file" yaml:"state_file"`
+}
+
+// budgetState is the spend of the current day and month, saved to BudgetConfig.StateFile
+type budgetState struct {
+	Day        string    `json:"day"` // 2006-01-02
+	DaySpend   float64   `json:"day_spend"`
+	Month      string    `json:"month"` // 2006-01
+	MonthSpend float64   `json:"month_spend"`
+	Updated    time.Time `json:"updated"`
+}
+
+// Budget guards the spend of the instances rented by one or more providers. Providers report the
+// $/hr of their running instances, the budget accrues it into the daily and monthly spend and
+// refuses new instances that would break a cap.
+type Budget struct {
+	config BudgetConfig
+	now    func() time.Time
+
+	mux     sync.Mutex
+	running map[string]float64 // $/hr by provider label
+	state   budgetState
+}
+
+// NewBudget creates a budget, loading the spend so far from the state file when there is one
+func NewBudget(config BudgetConfig) (*Budget, error) {
+	b := &Budget{config: config, now: time.Now, running: make(map[string]float64)}
+	if config.StateFile == "" {
+		return b, nil
+	}
+	data, err := os.ReadFile(config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.state); err != nil {
+		return nil, fmt.Errorf("budget state %s: %w", config.StateFile, err)
+	}
+	return b, nil
+}
+
+// PerHour returns the $/hr of the running instances
+func (b *Budget) PerHour() float64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.perHour()
+}
+
+// Spent returns the spend of the current day and month
+func (b *Budget) Spent() (day, month float64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.accrue()
+	return b.state.DaySpend, b.state.MonthSpend
+}
+
+// observe sets the $/hr of the running instances of owner
+func (b *Budget) observe(owner string, perHour float64) {
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.accrue()
+	b.running[owner] = perHour
+}
+
+// reserve takes price $/hr for a new instance of owner, or returns an ErrBudgetExceeded error
+// saying which cap it would break. The instance counts as running until the next observe.
+func (b *Budget) reserve(owner string, price float64) error {
+	if b == nil {
+		return nil
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.accrue()
+
+	var err error
+	switch perHour := b.perHour(); {
+	case b.config.MaxPerHour > 0 && perHour+price > b.config.MaxPerHour:
+		err = fmt.Errorf("%w: $%.3f/hr running plus $%.3f/hr is over the $%.2f/hr cap",
+			ErrBudgetExceeded, perHour, price, b.config.MaxPerHour)
+	case b.config.MaxPerDay > 0 && b.state.DaySpend >= b.config.MaxPerDay:
+		err = fmt.Errorf("%w: $%.2f spent today, the daily cap is $%.2f",
+			ErrBudgetExceeded, b.state.DaySpend, b.config.MaxPerDay)
+	case b.config.MaxPerMonth > 0 && b.state.MonthSpend >= b.config.MaxPerMonth:
+		err = fmt.Errorf("%w: $%.2f spent this month, the monthly cap is $%.2f",
+			ErrBudgetExceeded, b.state.MonthSpend, b.config.MaxPerMonth)
+	}
+	if err != nil {
+		log.Printf("budget: refusing a $%.3f/hr instance for %q: %v\n", price, owner, err)
+		return err
+	}
+	b.running[owner] += price
+	return nil
+}
+
+func (b *Budget) perHour() float64 {
+	var total float64
+	for _, perHour := range b.running {
+		total += perHour
+	}
+	return total
+}
+
+// accrue adds the spend of the running instances since the last update, b must be locked
+func (b *Budget) accrue() {
+	now := b.now().UTC()
+	if !b.state.Updated.IsZero() && now.After(b.state.Updated) {
+		spend := b.perHour() * now.Sub(b.state.Updated).Hours()
+		b.state.DaySpend += spend
+		b.state.MonthSpend += spend
+	}
+	// the spend of an update spanning midnight goes to the day before
+	if day := now.Format("2006-01-02"); day != b.state.Day {
+		b.state.Day, b.state.DaySpend = day, 0
+	}
+	if month := now.Format("2006-01"); month != b.state.Month {
+		b.state.Month, b.state.MonthSpend = month, 0
+	}
+	b.state.Updated = now
+	if err := b.save(); err != nil {
+		log.Printf("budget: save state err: %v\n", err)
+	}
+}
+
+// save writes the state file through a temporary file, so a crash never leaves half of it
+func (b *Budget) save() error {
+	if b.config.StateFile == "" {
+		return nil
+	}
+	data, _ := json.Marshal(b.state)
+	tmp, err := os.CreateTemp(filepath.Dir(b.config.StateFile), filepath.Base(b.config.StateFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.config.StateFile)
+}
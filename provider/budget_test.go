@@ -0,0 +1,55 @@
+package provider
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBudget_Caps(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "budget.json")
+	now := time.Date(2024, 3, 31, 20, 0, 0, 0, time.UTC)
+	newBudget := func() *Budget {
+		budget, err := NewBudget(BudgetConfig{MaxPerDay: 10, MaxPerMonth: 15, StateFile: stateFile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		budget.now = func() time.Time { return now }
+		return budget
+	}
+	budget := newBudget()
+
+	budget.observe("a", 1.5)
+	budget.observe("b", 0.5)
+	if err := budget.reserve("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	// $3/hr for 3h
+	now = now.Add(3 * time.Hour)
+	if day, month := budget.Spent(); math.Abs(day-9) > 1e-9 || math.Abs(month-9) > 1e-9 {
+		t.Errorf("spent %.2f today and %.2f this month, want 9 and 9", day, month)
+	}
+	if err := budget.reserve("b", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the spend survives a restart, which knows nothing about the running instances
+	budget = newBudget()
+	budget.observe("a", 2)
+	now = now.Add(30 * time.Minute)
+	err := budget.reserve("a", 1)
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("reserve err %v after $10 spent today, want ErrBudgetExceeded", err)
+	}
+
+	// a new day and month start from zero
+	now = now.Add(4 * time.Hour)
+	if day, month := budget.Spent(); day != 0 || month != 0 {
+		t.Errorf("spent %.2f today and %.2f this month after midnight, want 0 and 0", day, month)
+	}
+	if err := budget.reserve("a", 1); err != nil {
+		t.Fatal(err)
+	}
+}
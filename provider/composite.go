@@ -0,0 +1,232 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+type ScalingPolicy string
+
+const (
+	// ScalingPolicyFill assigns replicas to members in order, each up to its capacity
+	ScalingPolicyFill ScalingPolicy = "fill"
+	// ScalingPolicySpread assigns replicas to members one at a time in turn
+	ScalingPolicySpread ScalingPolicy = "spread"
+)
+
+// CapacityProvider is implemented by providers that can't grow past a fixed number of replicas
+type CapacityProvider interface {
+	MaxReplicas() int
+}
+
+// CompositeMember is a child provider of CompositeProvider
+type CompositeMember struct {
+	Name     string
+	Provider LLMProvider
+	// MaxReplicas caps the replicas assigned to the member, 0 falls back to
+	// CapacityProvider or unlimited
+	MaxReplicas int
+}
+
+// CompositeProvider merges the endpoints of several providers serving the same model into one pool
+type CompositeProvider struct {
+	members []CompositeMember
+	policy  ScalingPolicy
+
+	mux    sync.RWMutex
+	owners map[string]string  // endpoint id -> member name
+	last   [][]ServerEndpoint // endpoints of each member on its last successful GetEndpoints
+}
+
+func NewCompositeProvider(policy ScalingPolicy, members ...CompositeMember) (*CompositeProvider, error) {
+	if len(members) == 0 {
+		return nil, errors.New("composite provider needs at least one member")
+	}
+	if policy != ScalingPolicyFill && policy != ScalingPolicySpread {
+		return nil, fmt.Errorf("unknown scaling policy: %s", policy)
+	}
+	names := make(map[string]bool)
+	for _, m := range members {
+		if m.Name == "" || names[m.Name] {
+			return nil, fmt.Errorf("composite member names must be unique and not empty: %q", m.Name)
+		}
+		names[m.Name] = true
+		// the model names the pool and is what the backends are health checked against
+		if model, first := m.Provider.GetModel(), members[0].Provider.GetModel(); model != first {
+			return nil, fmt.Errorf("composite member %s serves %q, %s serves %q: all members must serve the same model",
+				m.Name, model, members[0].Name, first)
+		}
+	}
+	return &CompositeProvider{
+		members: members,
+		policy:  policy,
+		owners:  make(map[string]string),
+		last:    make([][]ServerEndpoint, len(members)),
+	}, nil
+}
+
+// GetModel returns the model all members serve, NewCompositeProvider checks they agree
+func (c *CompositeProvider) GetModel() string {
+	return c.members[0].Provider.GetModel()
+}
+
+// GetEndpoints queries all members in parallel and tags each endpoint with the member name
+// in ServerEndpoint.Origin. A failing member is logged and keeps the endpoints of its last
+// successful call, so its backends stay in the pool, unless all of them fail.
+func (c *CompositeProvider) GetEndpoints() ([]ServerEndpoint, error) {
+	results := make([][]ServerEndpoint, len(c.members))
+	errs := make([]error, len(c.members))
+	var wg sync.WaitGroup
+	for i := range c.members {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = c.members[i].Provider.GetEndpoints()
+		}(i)
+	}
+	wg.Wait()
+
+	var endpoints []ServerEndpoint
+	var failed []error
+	owners := make(map[string]string)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for i, m := range c.members {
+		if errs[i] != nil {
+			log.Printf("composite member %s GetEndpoints err: %v, keeping its %d endpoints\n", m.Name, errs[i], len(c.last[i]))
+			failed = append(failed, fmt.Errorf("%s: %w", m.Name, errs[i]))
+			results[i] = c.last[i]
+		}
+		for _, endpoint := range results[i] {
+			endpoint.Origin = m.Name
+			owners[endpoint.ID] = m.Name
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(failed) == len(c.members) {
+		return nil, errors.Join(failed...)
+	}
+
+	c.owners = owners
+	copy(c.last, results)
+	return endpoints, nil
+}
+
+// AutoScaling splits replica across members according to the scaling policy
+func (c *CompositeProvider) AutoScaling(replica int) error {
+	if replica < 0 {
+		return fmt.Errorf("invalid replica count: %d", replica)
+	}
+	targets, unplaced := c.split(replica)
+	var errs []error
+	if unplaced > 0 {
+		errs = append(errs, fmt.Errorf("%d replicas exceed the capacity of all members", unplaced))
+	}
+	for i, m := range c.members {
+		if err := m.Provider.AutoScaling(targets[i]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// split returns the replicas of each member and the number of replicas that didn't fit
+func (c *CompositeProvider) split(replica int) ([]int, int) {
+	targets := make([]int, len(c.members))
+	capacity := make([]int, len(c.members)) // -1 means unlimited
+	for i, m := range c.members {
+		capacity[i] = -1
+		if m.MaxReplicas > 0 {
+			capacity[i] = m.MaxReplicas
+		} else if p, ok := m.Provider.(CapacityProvider); ok {
+			capacity[i] = p.MaxReplicas()
+		}
+	}
+	free := func(i int) bool {
+		return capacity[i] < 0 || targets[i] < capacity[i]
+	}
+
+	switch c.policy {
+	case ScalingPolicyFill:
+		for i := range c.members {
+			for replica > 0 && free(i) {
+				targets[i]++
+				replica--
+			}
+		}
+	case ScalingPolicySpread:
+		for replica > 0 {
+			placed := false
+			for i := range c.members {
+				if replica > 0 && free(i) {
+					targets[i]++
+					replica--
+					placed = true
+				}
+			}
+			if !placed {
+				break
+			}
+		}
+	}
+	return targets, replica
+}
+
+// SetErrorReporter passes report on to the members that are ErrorReporters
+func (c *CompositeProvider) SetErrorReporter(report func(operation string, err error)) {
+	for _, m := range c.members {
+		if reporter, ok := m.Provider.(ErrorReporter); ok {
+			reporter.SetErrorReporter(report)
+		}
+	}
+}
+
+func (c *CompositeProvider) DestroyInstance(id string) error {
+	p, err := c.owner(id)
+	if err != nil {
+		return err
+	}
+	return p.DestroyInstance(id)
+}
+
+func (c *CompositeProvider) StopInstance(id string) error {
+	p, err := c.owner(id)
+	if err != nil {
+		return err
+	}
+	return p.StopInstance(id)
+}
+
+func (c *CompositeProvider) StartInstance(id string) error {
+	p, err := c.owner(id)
+	if err != nil {
+		return err
+	}
+	return p.StartInstance(id)
+}
+
+func (c *CompositeProvider) RebootInstance(id string) error {
+	p, err := c.owner(id)
+	if err != nil {
+		return err
+	}
+	return p.RebootInstance(id)
+}
+
+// owner returns the member that reported the endpoint id on the last GetEndpoints
+func (c *CompositeProvider) owner(id string) (LLMProvider, error) {
+	c.mux.RLock()
+	name, ok := c.owners[id]
+	c.mux.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown endpoint id: %s", id)
+	}
+	for _, m := range c.members {
+		if m.Name == name {
+			return m.Provider, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown endpoint id: %s", id)
+}
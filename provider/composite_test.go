@@ -0,0 +1,151 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type stubProvider struct {
+	endpoints []ServerEndpoint
+	err       error
+	replica   int
+	capacity  int
+	destroyed []string
+}
+
+func (s *stubProvider) GetEndpoints() ([]ServerEndpoint, error) { return s.endpoints, s.err }
+func (s *stubProvider) GetModel() string                        { return "mixtral" }
+func (s *stubProvider) AutoScaling(replica int) error {
+	s.replica = replica
+	return nil
+}
+func (s *stubProvider) DestroyInstance(id string) error {
+	s.destroyed = append(s.destroyed, id)
+	return nil
+}
+func (s *stubProvider) StopInstance(id string) error   { return ErrNotSupported }
+func (s *stubProvider) StartInstance(id string) error  { return ErrNotSupported }
+func (s *stubProvider) RebootInstance(id string) error { return ErrNotSupported }
+
+type stubCapacityProvider struct {
+	stubProvider
+}
+
+func (s *stubCapacityProvider) MaxReplicas() int { return s.capacity }
+
+func TestCompositeProvider_GetEndpoints(t *testing.T) {
+	static := &stubProvider{endpoints: []ServerEndpoint{{ID: "gpu-1"}, {ID: "gpu-2"}}}
+	cloud := &stubProvider{err: errors.New("vast.ai unavailable")}
+	composite, err := NewCompositeProvider(ScalingPolicyFill,
+		CompositeMember{Name: "onprem", Provider: static},
+		CompositeMember{Name: "cloud", Provider: cloud},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints, err := composite.GetEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 2 || endpoints[0].Origin != "onprem" {
+		t.Errorf("unexpected endpoints: %+v", endpoints)
+	}
+	if err := composite.DestroyInstance("gpu-2"); err != nil || len(static.destroyed) != 1 {
+		t.Errorf("destroy not routed to owner: %v %v", err, static.destroyed)
+	}
+	if err := composite.DestroyInstance("unknown"); err == nil {
+		t.Error("expected error for unknown endpoint")
+	}
+
+	static.err = errors.New("file missing")
+	if _, err := composite.GetEndpoints(); err == nil {
+		t.Error("expected error when all members fail")
+	}
+}
+
+func TestCompositeProvider_MemberFailure(t *testing.T) {
+	static := &stubProvider{endpoints: []ServerEndpoint{{ID: "gpu-1"}}}
+	cloud := &stubProvider{endpoints: []ServerEndpoint{{ID: "vast-1"}, {ID: "vast-2"}}}
+	composite, err := NewCompositeProvider(ScalingPolicyFill,
+		CompositeMember{Name: "onprem", Provider: static},
+		CompositeMember{Name: "cloud", Provider: cloud},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := composite.GetEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failing member keeps the endpoints it reported last
+	cloud.endpoints, cloud.err = nil, errors.New("vast.ai unavailable")
+	static.endpoints = append(static.endpoints, ServerEndpoint{ID: "gpu-2"})
+	endpoints, err := composite.GetEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(endpoints) != fmt.Sprint([]ServerEndpoint{{ID: "gpu-1", Origin: "onprem"}, {ID: "gpu-2", Origin: "onprem"},
+		{ID: "vast-1", Origin: "cloud"}, {ID: "vast-2", Origin: "cloud"}}) {
+		t.Errorf("unexpected endpoints: %+v", endpoints)
+	}
+	if err := composite.DestroyInstance("vast-2"); err != nil || len(cloud.destroyed) != 1 {
+		t.Errorf("destroy not routed to the failing member: %v %v", err, cloud.destroyed)
+	}
+}
+
+func TestCompositeProvider_AutoScaling(t *testing.T) {
+	tests := []struct {
+		policy   ScalingPolicy
+		replica  int
+		expected string
+	}{
+		{ScalingPolicyFill, 1, "[1 0 0]"},
+		{ScalingPolicyFill, 5, "[2 3 0]"},
+		{ScalingPolicySpread, 5, "[2 2 1]"},
+		{ScalingPolicySpread, 9, "[2 4 3]"},
+	}
+	for _, tt := range tests {
+		static := &stubCapacityProvider{stubProvider{capacity: 2}}
+		cloud := &stubProvider{}
+		burst := &stubProvider{}
+		composite, err := NewCompositeProvider(tt.policy,
+			CompositeMember{Name: "onprem", Provider: static},
+			CompositeMember{Name: "cloud", Provider: cloud, MaxReplicas: 4},
+			CompositeMember{Name: "burst", Provider: burst},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := composite.AutoScaling(tt.replica); err != nil {
+			t.Fatal(err)
+		}
+		got := fmt.Sprint([]int{static.replica, cloud.replica, burst.replica})
+		if got != tt.expected {
+			t.Errorf("%s %d: got %s, want %s", tt.policy, tt.replica, got, tt.expected)
+		}
+	}
+
+	static := &stubCapacityProvider{stubProvider{capacity: 2}}
+	composite, _ := NewCompositeProvider(ScalingPolicyFill, CompositeMember{Name: "onprem", Provider: static})
+	if err := composite.AutoScaling(3); err == nil {
+		t.Error("expected error when replicas exceed capacity")
+	}
+}
+
+type otherModelProvider struct {
+	stubProvider
+}
+
+func (s *otherModelProvider) GetModel() string { return "llama" }
+
+func TestCompositeProvider_ModelMismatch(t *testing.T) {
+	_, err := NewCompositeProvider(ScalingPolicyFill,
+		CompositeMember{Name: "static", Provider: &otherModelProvider{}},
+		CompositeMember{Name: "vastai", Provider: &stubProvider{}},
+	)
+	if err == nil {
+		t.Error("members serving different models were merged")
+	}
+}
@@ -0,0 +1,140 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// ErrNoOffers is returned when no vast.ai offer matches the instance template
+var ErrNoOffers = errors.New("no offers match the instance template")
+
+// OfferRanking names the score offers are ranked by, the highest score is rented first
+type OfferRanking string
+
+const (
+	// RankByPrice prefers the lowest $/hr
+	RankByPrice OfferRanking = "price"
+	// RankByDlperfPerDollar prefers the most deep learning performance per $/hr
+	RankByDlperfPerDollar OfferRanking = "dlperf_per_dollar"
+	// RankByFlopsPerDollar prefers the most TFLOPS per $/hr
+	RankByFlopsPerDollar OfferRanking = "flops_per_dollar"
+	// RankByCostPerToken prefers the lowest cost per generated token, from InstanceTemplate.TokensPerSecond
+	RankByCostPerToken OfferRanking = "cost_per_token"
+)
+
+// ranking returns the ranking of the template, price when unset
+func (t *InstanceTemplate) ranking() OfferRanking {
+	if t.Ranking == "" {
+		return RankByPrice
+	}
+	return t.Ranking
+}
+
+// order is the bundles search order, so the offers the search leaves out are the worst ranked
+func (t *InstanceTemplate) order() [][]string {
+	switch t.Ranking {
+	case RankByDlperfPerDollar:
+		return [][]string{{"dlperf_per_dphtotal", "desc"}}
+	case RankByFlopsPerDollar:
+		return [][]string{{"flops_per_dphtotal", "desc"}}
+	}
+	if t.Interruptible && t.BidPrice == 0 {
+		return [][]string{{"min_bid", "asc"}, {"total_flops", "asc"}}
+	}
+	return [][]string{{"dphtotal", "asc"}, {"total_flops", "asc"}}
+}
+
+// RankedOffer is an offer with its score under the ranking of the template
+type RankedOffer struct {
+	Offer
+	// Price is what the offer costs in $/hr, the bid for interruptible instances
+	Price         float64
+	Interruptible bool
+	Score         float64
+	// CostPerMillionTokens is the $ per million generated tokens, 0 when the GPU speed is unknown
+	CostPerMillionTokens float64
+}
+
+// String summarizes the offer in one line
+func (o RankedOffer) String() string {
+	kind := "on-demand"
+	if o.Interruptible {
+		kind = "bid"
+	}
+	s := fmt.Sprintf("offer %d: %dx %s %.0fGB, %s $%.3f/hr, dlperf %.1f, reliability %.3f, %s, %.0f/%.0f Mbps, cuda %.1f, score %.4g",
+		o.Id, o.NumGpus, o.GpuName, float64(o.GpuRam)/1000, kind, o.Price, o.Dlperf, o.Reliability2,
+		o.Geolocation, o.InetDown, o.InetUp, o.CudaMaxGood, o.Score)
+	if o.CostPerMillionTokens > 0 {
+		s += fmt.Sprintf(", $%.3f/M tokens", o.CostPerMillionTokens)
+	}
+	return s
+}
+
+// RankOffers scores the offers under the ranking of the template and sorts them best first. Offers
+// without a price, and with an unknown GPU speed under the cost_per_token ranking, are left out.
+func (t *InstanceTemplate) RankOffers(offers []Offer) []RankedOffer {
+	ranked := make([]RankedOffer, 0, len(offers))
+	for _, offer := range offers {
+		price := t.price(offer)
+		if price <= 0 {
+			continue
+		}
+		o := RankedOffer{Offer: offer, Price: price, Interruptible: t.Interruptible}
+		if tokensPerSecond := t.TokensPerSecond[offer.GpuName] * float64(max(offer.NumGpus, 1)); tokensPerSecond > 0 {
+			o.CostPerMillionTokens = price / (tokensPerSecond * 3600) * 1e6
+		}
+		switch t.Ranking {
+		case RankByDlperfPerDollar:
+			o.Score = offer.Dlperf / price
+		case RankByFlopsPerDollar:
+			o.Score = offer.TotalFlops / price
+		case RankByCostPerToken:
+			if o.CostPerMillionTokens == 0 {
+				continue
+			}
+			// million tokens per $
+			o.Score = 1 / o.CostPerMillionTokens
+		default:
+			o.Score = 1 / price
+		}
+		ranked = append(ranked, o)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].Price < ranked[j].Price
+	})
+	return ranked
+}
+
+// SearchOffers returns the offers matching the instance template, best ranked first. The error is
+// ErrNoOffers when there are none.
+func (v *VastAIProvider) SearchOffers() ([]RankedOffer, error) {
+	return v.searchOffers(v.template)
+}
+
+func (v *VastAIProvider) searchOffers(template *InstanceTemplate) ([]RankedOffer, error) {
+	query, _ := json.Marshal(template.BundleQuery())
+	data, err := v.request("GET", fmt.Sprintf("%s/bundles?q=%s", v.baseURL, url.QueryEscape(string(query))), nil)
+	if err != nil {
+		return nil, fmt.Errorf("query offers: %w", err)
+	}
+
+	var response QueryBundleResponse
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return nil, fmt.Errorf("query offers: %w", err)
+	}
+	if len(response.Offers) == 0 {
+		return nil, ErrNoOffers
+	}
+	ranked := template.RankOffers(response.Offers)
+	if len(ranked) == 0 {
+		return nil, fmt.Errorf("%w: none of the %d offers can be ranked by %s", ErrNoOffers, len(response.Offers), template.ranking())
+	}
+	return ranked, nil
+}
@@ -0,0 +1,132 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInstanceTemplate_RankOffers(t *testing.T) {
+	offers := []Offer{
+		{Id: 1, GpuName: "RTX 4090", NumGpus: 1, DphTotal: 0.5, Dlperf: 80, TotalFlops: 80},
+		{Id: 2, GpuName: "RTX 3090", NumGpus: 1, DphTotal: 0.25, Dlperf: 30, TotalFlops: 45},
+		{Id: 3, GpuName: "A100", NumGpus: 2, DphTotal: 2, Dlperf: 300, TotalFlops: 300},
+		{Id: 4, GpuName: "RTX 4090", NumGpus: 1}, // no price
+	}
+	for _, test := range []struct {
+		ranking OfferRanking
+		want    []int
+	}{
+		{"", []int{2, 1, 3}},
+		{RankByDlperfPerDollar, []int{1, 3, 2}},
+		{RankByFlopsPerDollar, []int{2, 1, 3}},
+		// 0.5 / (100*3600) beats 0.25 / (40*3600), the A100 speed is unknown
+		{RankByCostPerToken, []int{1, 2}},
+	} {
+		template := DefaultInstanceTemplate()
+		template.Ranking = test.ranking
+		template.TokensPerSecond = map[string]float64{"RTX 4090": 100, "RTX 3090": 40}
+		ranked := template.RankOffers(offers)
+		var ids []int
+		for _, offer := range ranked {
+			ids = append(ids, offer.Id)
+		}
+		if len(ids) != len(test.want) {
+			t.Errorf("%s: ranked %v, want %v", test.ranking, ids, test.want)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.want[i] {
+				t.Errorf("%s: ranked %v, want %v", test.ranking, ids, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestInstanceTemplate_Validate(t *testing.T) {
+	template := DefaultInstanceTemplate()
+	template.Ranking = RankByCostPerToken
+	if err := template.Validate(); err == nil {
+		t.Error("cost_per_token without tokens_per_second validated")
+	}
+	template.Ranking = "cheapest"
+	if err := template.Validate(); err == nil {
+		t.Error("unknown ranking validated")
+	}
+}
+
+func TestInstanceTemplate_BundleQueryFilters(t *testing.T) {
+	template := DefaultInstanceTemplate()
+	template.Geolocations = []string{"US", "CA"}
+	template.MinInetDown = 500
+	template.MinCUDA = 12.1
+	template.Ranking = RankByDlperfPerDollar
+	query := template.BundleQuery()
+
+	if locations := query["geolocation"].(map[string]interface{})["in"].([]string); len(locations) != 2 {
+		t.Errorf("unexpected geolocation filter: %v", query["geolocation"])
+	}
+	if query["inet_down"].(map[string]interface{})["gte"] != 500.0 {
+		t.Errorf("unexpected inet_down filter: %v", query["inet_down"])
+	}
+	if query["cuda_max_good"].(map[string]interface{})["gte"] != 12.1 {
+		t.Errorf("unexpected cuda_max_good filter: %v", query["cuda_max_good"])
+	}
+	if _, ok := query["inet_up"]; ok {
+		t.Errorf("unset inet_up filtered: %v", query["inet_up"])
+	}
+	if order := query["order"].([][]string); order[0][0] != "dlperf_per_dphtotal" || order[0][1] != "desc" {
+		t.Errorf("unexpected order: %v", order)
+	}
+}
+
+func TestVastAIProvider_SearchOffers(t *testing.T) {
+	fake := &fakeVastAI{offers: `{"offers": []}`}
+	provider := newFakeVastAIProvider(t, fake)
+
+	if _, err := provider.SearchOffers(); !errors.Is(err, ErrNoOffers) {
+		t.Fatalf("SearchOffers err %v, want ErrNoOffers", err)
+	}
+	if _, err := provider.createInstance(provider.template); !errors.Is(err, ErrNoOffers) {
+		t.Fatalf("createInstance err %v, want ErrNoOffers", err)
+	}
+
+	// the best ranked offer is rented, not the first one returned
+	fake.offers = `{"offers": [{"id": 1, "dph_total": 0.5, "dlperf": 40}, {"id": 2, "dph_total": 0.6, "dlperf": 90}]}`
+	provider.template.Ranking = RankByDlperfPerDollar
+	if _, err := provider.createInstance(provider.template); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.rented) != 1 || fake.rented[0] != 2 {
+		t.Errorf("rented offers %v, want [2]", fake.rented)
+	}
+}
+
+func TestInstanceTemplate_Interruptible(t *testing.T) {
+	template := DefaultInstanceTemplate()
+	template.Interruptible = true
+	template.MaxPrice = 0.5
+	query := template.BundleQuery()
+	if query["type"] != "bid" {
+		t.Errorf("query type %v, want bid", query["type"])
+	}
+	if _, ok := query["dph_total"]; ok {
+		t.Errorf("on-demand price filtered for bids: %v", query["dph_total"])
+	}
+
+	// the cheapest bid wins over the cheapest on-demand price
+	offers := []Offer{
+		{Id: 1, DphTotal: 0.3, MinBid: 0.2},
+		{Id: 2, DphTotal: 0.4, MinBid: 0.1},
+	}
+	if ranked := template.RankOffers(offers); ranked[0].Id != 2 || ranked[0].Price != 0.1 {
+		t.Errorf("best offer %d at %v, want 2 at 0.1", ranked[0].Id, ranked[0].Price)
+	}
+	template.BidPrice = 0.25
+	if query := template.BundleQuery(); query["min_bid"].(map[string]interface{})["lte"] != 0.25 {
+		t.Errorf("unexpected min_bid filter: %v", query["min_bid"])
+	}
+	if ranked := template.onDemand().RankOffers(offers); ranked[0].Id != 1 || ranked[0].Price != 0.3 {
+		t.Errorf("best on-demand offer %d at %v, want 1 at 0.3", ranked[0].Id, ranked[0].Price)
+	}
+}
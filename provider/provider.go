@@ -1,15 +1,41 @@
 package provider
 
+import "errors"
+
+// ErrNotSupported is returned by providers for operations they can't perform
+var ErrNotSupported = errors.New("operation not supported")
+
 type ServerEndpoint struct {
 	ID      string
 	Host    string
 	Port    int
 	CPUName string
 	GPUName string
+	Model   string
+	Weight  int
+	Origin  string // name of the provider the endpoint comes from
+	// MaxConcurrency is the number of concurrent requests the endpoint takes, 0 derives it from GPUName
+	MaxConcurrency int
+	// PricePerHour is what the endpoint costs in $/hr, used to charge usage back
+	PricePerHour float64
 }
 
 type LLMProvider interface {
 	GetEndpoints() ([]ServerEndpoint, error)
 	AutoScaling(replica int) error
 	GetModel() string
+	// DestroyInstance releases the instance behind ServerEndpoint.ID for good
+	DestroyInstance(id string) error
+	// StopInstance pauses the instance behind ServerEndpoint.ID, it can be started again
+	StopInstance(id string) error
+	// StartInstance resumes a stopped instance
+	StartInstance(id string) error
+	// RebootInstance restarts the instance behind ServerEndpoint.ID
+	RebootInstance(id string) error
+}
+
+// ErrorReporter is implemented by providers that tell about their failed api calls by operation,
+// including the ones made on their own such as destroying preempted instances
+type ErrorReporter interface {
+	SetErrorReporter(report func(operation string, err error))
 }
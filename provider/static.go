@@ -0,0 +1,129 @@
+package provider
+
+import (
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/utils"
+	"log"
+	"sync"
+)
+
+// StaticConfig is the file format read by StaticProvider
+type StaticConfig struct {
+	Model     string                 `json:"model" yaml:"model"`
+	Endpoints []StaticEndpointConfig `json:"endpoints" yaml:"endpoints"`
+}
+
+type StaticEndpointConfig struct {
+	ID      string `json:"id" yaml:"id"`
+	Host    string `json:"host" yaml:"host"`
+	Port    int    `json:"port" yaml:"port"`
+	CPUName string `json:"cpu_name" yaml:"cpu_name"`
+	GPUName string `json:"gpu_name" yaml:"gpu_name"`
+	Weight  int    `json:"weight" yaml:"weight"`
+	Model   string `json:"model" yaml:"model"`
+	// MaxConcurrency overrides the concurrency limit derived from the GPU name
+	MaxConcurrency int `json:"max_concurrency" yaml:"max_concurrency"`
+	// PricePerHour is the $/hr cost used to charge usage back
+	PricePerHour float64 `json:"price_per_hour" yaml:"price_per_hour"`
+}
+
+// StaticProvider serves self-hosted backends listed in a config file.
+// The file is read again on every GetEndpoints, so edits apply on the next reload.
+type StaticProvider struct {
+	path string
+
+	mux   sync.RWMutex
+	model string
+	size  int
+}
+
+func NewStaticProvider(path string) (*StaticProvider, error) {
+	s := &StaticProvider{path: path}
+	if _, err := s.GetEndpoints(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *StaticProvider) GetModel() string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.model
+}
+
+func (s *StaticProvider) GetEndpoints() ([]ServerEndpoint, error) {
+	var config StaticConfig
+	if err := utils.LoadConfigFile(s.path, &config); err != nil {
+		return nil, err
+	}
+	if config.Model == "" {
+		return nil, fmt.Errorf("%s: model is empty", s.path)
+	}
+
+	endpoints := make([]ServerEndpoint, 0, len(config.Endpoints))
+	for i, e := range config.Endpoints {
+		if e.Host == "" || e.Port <= 0 {
+			return nil, fmt.Errorf("%s: endpoint %d needs a host and a port", s.path, i)
+		}
+		endpoint := ServerEndpoint{
+			ID:      e.ID,
+			Host:    e.Host,
+			Port:    e.Port,
+			CPUName: e.CPUName,
+			GPUName: e.GPUName,
+			Model:   e.Model,
+			Weight:  e.Weight,
+			Origin:  "static",
+
+			MaxConcurrency: e.MaxConcurrency,
+			PricePerHour:   e.PricePerHour,
+		}
+		if endpoint.ID == "" {
+			endpoint.ID = fmt.Sprintf("%s:%d", e.Host, e.Port)
+		}
+		if endpoint.Model == "" {
+			endpoint.Model = config.Model
+		}
+		if endpoint.Weight <= 0 {
+			endpoint.Weight = 1
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	s.mux.Lock()
+	if s.model != "" && s.model != config.Model {
+		log.Printf("%s: model changed from %s to %s\n", s.path, s.model, config.Model)
+	}
+	s.model = config.Model
+	s.size = len(endpoints)
+	s.mux.Unlock()
+	return endpoints, nil
+}
+
+// MaxReplicas is the number of endpoints listed in the file, see CapacityProvider
+func (s *StaticProvider) MaxReplicas() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.size
+}
+
+// AutoScaling is a no-op, static backends are managed outside the gateway
+func (s *StaticProvider) AutoScaling(replica int) error {
+	return nil
+}
+
+func (s *StaticProvider) DestroyInstance(id string) error {
+	return fmt.Errorf("destroy static endpoint %s: %w", id, ErrNotSupported)
+}
+
+func (s *StaticProvider) StopInstance(id string) error {
+	return fmt.Errorf("stop static endpoint %s: %w", id, ErrNotSupported)
+}
+
+func (s *StaticProvider) StartInstance(id string) error {
+	return fmt.Errorf("start static endpoint %s: %w", id, ErrNotSupported)
+}
+
+func (s *StaticProvider) RebootInstance(id string) error {
+	return fmt.Errorf("reboot static endpoint %s: %w", id, ErrNotSupported)
+}
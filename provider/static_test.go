@@ -0,0 +1,68 @@
+package provider
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticProvider_GetEndpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.yaml")
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+model: mixtral
+endpoints:
+  - host: 10.0.0.5
+    port: 5000
+    gpu_name: RTX 4090
+    weight: 2
+  - id: a100
+    host: 10.0.0.6
+    port: 5000
+    model: mixtral-lora
+`)
+	provider, err := NewStaticProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err := provider.GetEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 2 {
+		t.Fatalf("got %d endpoints, want 2", len(endpoints))
+	}
+	if e := endpoints[0]; e.ID != "10.0.0.5:5000" || e.Weight != 2 || e.Model != "mixtral" || e.GPUName != "RTX 4090" {
+		t.Errorf("unexpected endpoint: %+v", e)
+	}
+	if e := endpoints[1]; e.ID != "a100" || e.Weight != 1 || e.Model != "mixtral-lora" {
+		t.Errorf("unexpected endpoint: %+v", e)
+	}
+
+	// edits are picked up on the next call
+	write(`
+model: llama
+endpoints:
+  - host: 10.0.0.7
+    port: 5000
+`)
+	endpoints, err = provider.GetEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || provider.GetModel() != "llama" {
+		t.Errorf("reload not applied: %+v, model %s", endpoints, provider.GetModel())
+	}
+
+	if err := provider.AutoScaling(3); err != nil {
+		t.Errorf("AutoScaling: %v", err)
+	}
+	if err := provider.DestroyInstance("a100"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("DestroyInstance: %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/utils"
+	"strings"
+	"text/template"
+)
+
+const defaultOnstart = `env | grep _ >> /etc/environment; pip install accelerate -U; pip install protobuf; ` +
+	`python3 /app/download-model.py --output /app/models --branch {{.Branch}} {{.Model}}; ` +
+	`{{if ne .DownloadDir .ModelName}}ln -sfn /app/models/{{.DownloadDir}} /app/models/{{.ModelName}}; {{end}}` +
+	`cd /app; /scripts/docker-entrypoint.sh python3 /app/server.py --listen --api --verbose ` +
+	`--loader {{.Loader}} --model {{.ModelName}};`
+
+// InstanceTemplate describes the vast.ai offers to rent and how to start the model on them
+type InstanceTemplate struct {
+	GPUNames       []string          `json:"gpu_names" yaml:"gpu_names"`
+	NumGPUs        int               `json:"num_gpus" yaml:"num_gpus"`
+	MinVRAM        float64           `json:"min_vram" yaml:"min_vram"` // GB per GPU
+	MinDlperf      float64           `json:"min_dlperf" yaml:"min_dlperf"`
+	Disk           float64           `json:"disk" yaml:"disk"` // GB
+	MinReliability float64           `json:"min_reliability" yaml:"min_reliability"`
+	MaxPrice       float64           `json:"max_price" yaml:"max_price"` // on-demand $/hr, 0 means no limit
+	Image          string            `json:"image" yaml:"image"`
+	Loader         string            `json:"loader" yaml:"loader"`
+	Env            map[string]string `json:"env" yaml:"env"`
+	Onstart        string            `json:"onstart" yaml:"onstart"` // text/template rendered with OnstartParams
+
+	Geolocations []string `json:"geolocations" yaml:"geolocations"`   // country codes, e.g. US, empty is anywhere
+	MinInetDown  float64  `json:"min_inet_down" yaml:"min_inet_down"` // Mbps
+	MinInetUp    float64  `json:"min_inet_up" yaml:"min_inet_up"`     // Mbps
+	MinCUDA      float64  `json:"min_cuda" yaml:"min_cuda"`           // CUDA version the driver supports, e.g. 12.1
+	// Ranking orders the matching offers, the first one is rented, default price
+	Ranking OfferRanking `json:"ranking" yaml:"ranking"`
+	// TokensPerSecond is the generation speed of the model by GPU name, used by the cost_per_token ranking
+	TokensPerSecond map[string]float64 `json:"tokens_per_second" yaml:"tokens_per_second"`
+
+	// Interruptible rents at a bid instead of on-demand, cheaper but the instance stops when outbid
+	Interruptible bool `json:"interruptible" yaml:"interruptible"`
+	// BidPrice is the bid in $/hr, offers asking a higher minimum bid are left out. 0 bids the minimum.
+	BidPrice float64 `json:"bid_price" yaml:"bid_price"`
+}
+
+// OnstartParams are the values available to InstanceTemplate.Onstart
+type OnstartParams struct {
+	Model       string // huggingface repository, e.g. TheBloke/Mixtral-8x7B-Instruct-v0.1-GPTQ
+	Branch      string
+	DownloadDir string // folder name download-model.py saves the model to
+	ModelName   string // model name the server loads and reports, see VastAIProvider.GetModel
+	Loader      string
+}
+
+// DefaultInstanceTemplate returns the template used when none is configured
+func DefaultInstanceTemplate() *InstanceTemplate {
+	return &InstanceTemplate{
+		GPUNames:       []string{"RTX 4090"},
+		NumGPUs:        1,
+		MinDlperf:      70,
+		Disk:           30,
+		MinReliability: 0.99,
+		Image:          "atinoda/text-generation-webui:default-snapshot-2023-12-31",
+		Loader:         "ExLlamav2_HF",
+		Onstart:        defaultOnstart,
+	}
+}
+
+// LoadInstanceTemplate reads a template from a YAML or JSON file, unset fields keep their defaults
+func LoadInstanceTemplate(path string) (*InstanceTemplate, error) {
+	t := DefaultInstanceTemplate()
+	if err := utils.LoadConfigFile(path, t); err != nil {
+		return nil, err
+	}
+	if err := t.Validate(); err != nil {
+		return nil, fmt.Errorf("instance template %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// Validate reports template settings that can never match an offer
+func (t *InstanceTemplate) Validate() error {
+	if len(t.GPUNames) == 0 {
+		return fmt.Errorf("gpu_names is empty")
+	}
+	if t.NumGPUs < 1 {
+		return fmt.Errorf("num_gpus must be at least 1")
+	}
+	if t.Disk <= 0 {
+		return fmt.Errorf("disk must be positive")
+	}
+	if t.Image == "" {
+		return fmt.Errorf("image is empty")
+	}
+	if t.BidPrice < 0 {
+		return fmt.Errorf("bid_price must not be negative")
+	}
+	switch t.Ranking {
+	case "", RankByPrice, RankByDlperfPerDollar, RankByFlopsPerDollar:
+	case RankByCostPerToken:
+		if len(t.TokensPerSecond) == 0 {
+			return fmt.Errorf("ranking %s needs tokens_per_second", t.Ranking)
+		}
+	default:
+		return fmt.Errorf("unknown ranking %q", t.Ranking)
+	}
+	if _, err := template.New("onstart").Parse(t.Onstart); err != nil {
+		return fmt.Errorf("onstart: %w", err)
+	}
+	return nil
+}
+
+// BundleQuery builds the vast.ai bundles search query for the template
+func (t *InstanceTemplate) BundleQuery() map[string]interface{} {
+	query := map[string]interface{}{
+		"verified":   map[string]interface{}{"eq": true},
+		"external":   map[string]interface{}{"eq": false},
+		"rentable":   map[string]interface{}{"eq": true},
+		"rented":     map[string]interface{}{"eq": false},
+		"disk_space": map[string]interface{}{"gte": t.Disk},
+		"gpu_name":   map[string]interface{}{"in": t.GPUNames},
+		"num_gpus":   map[string]interface{}{"eq": t.NumGPUs},
+		"order":      t.order(),
+		"type":       "on-demand",
+	}
+	if t.Interruptible {
+		query["type"] = "bid"
+		if t.BidPrice > 0 {
+			query["min_bid"] = map[string]interface{}{"lte": t.BidPrice}
+		}
+	}
+	if t.MinReliability > 0 {
+		query["reliability2"] = map[string]interface{}{"gt": t.MinReliability}
+	}
+	if t.MinDlperf > 0 {
+		query["dlperf"] = map[string]interface{}{"gt": t.MinDlperf}
+	}
+	if t.MinVRAM > 0 {
+		// gpu_ram is reported in MB
+		query["gpu_ram"] = map[string]interface{}{"gte": t.MinVRAM * 1000}
+	}
+	if t.MaxPrice > 0 && !t.Interruptible {
+		query["dph_total"] = map[string]interface{}{"lte": t.MaxPrice}
+	}
+	if len(t.Geolocations) > 0 {
+		query["geolocation"] = map[string]interface{}{"in": t.Geolocations}
+	}
+	if t.MinInetDown > 0 {
+		query["inet_down"] = map[string]interface{}{"gte": t.MinInetDown}
+	}
+	if t.MinInetUp > 0 {
+		query["inet_up"] = map[string]interface{}{"gte": t.MinInetUp}
+	}
+	if t.MinCUDA > 0 {
+		query["cuda_max_good"] = map[string]interface{}{"gte": t.MinCUDA}
+	}
+	return query
+}
+
+// price returns what renting offer costs in $/hr, the bid for interruptible instances
+func (t *InstanceTemplate) price(offer Offer) float64 {
+	if !t.Interruptible {
+		return offer.DphTotal
+	}
+	if t.BidPrice > 0 {
+		return t.BidPrice
+	}
+	return offer.MinBid
+}
+
+// onDemand returns a copy of the template renting on-demand instances
+func (t *InstanceTemplate) onDemand() *InstanceTemplate {
+	onDemand := *t
+	onDemand.Interruptible = false
+	return &onDemand
+}
+
+// RenderOnstart renders the onstart command that downloads and serves model at branch
+func (t *InstanceTemplate) RenderOnstart(model, branch string) (string, error) {
+	tmpl, err := template.New("onstart").Parse(t.Onstart)
+	if err != nil {
+		return "", err
+	}
+	downloadDir := strings.Join(lastN(strings.Split(model, "/"), 2), "_")
+	if branch != "main" {
+		downloadDir = fmt.Sprintf("%s_%s", downloadDir, branch)
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, OnstartParams{
+		Model:       model,
+		Branch:      branch,
+		DownloadDir: downloadDir,
+		ModelName:   modelName(model, branch),
+		Loader:      t.Loader,
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// modelName is the folder name the model is served under
+func modelName(model, branch string) string {
+	return fmt.Sprintf("%s_%s", strings.ReplaceAll(model, "/", "_"), branch)
+}
+
+func lastN(s []string, n int) []string {
+	if len(s) > n {
+		return s[len(s)-n:]
+	}
+	return s
+}
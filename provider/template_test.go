@@ -0,0 +1,65 @@
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInstanceTemplate_RenderOnstart(t *testing.T) {
+	template := DefaultInstanceTemplate()
+
+	onstart, err := template.RenderOnstart("TheBloke/Mixtral-8x7B-Instruct-v0.1-GPTQ", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"--branch main TheBloke/Mixtral-8x7B-Instruct-v0.1-GPTQ;",
+		"ln -sfn /app/models/TheBloke_Mixtral-8x7B-Instruct-v0.1-GPTQ /app/models/TheBloke_Mixtral-8x7B-Instruct-v0.1-GPTQ_main;",
+		"--loader ExLlamav2_HF --model TheBloke_Mixtral-8x7B-Instruct-v0.1-GPTQ_main;",
+	} {
+		if !strings.Contains(onstart, want) {
+			t.Errorf("onstart %q does not contain %q", onstart, want)
+		}
+	}
+
+	// download-model.py already appends non-main branches to the folder name
+	onstart, err = template.RenderOnstart("TheBloke/U-Amethyst-20B-GPTQ", "gptq-4bit-32g-actorder_True")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(onstart, "ln -sfn") {
+		t.Errorf("onstart %q should not link the model folder", onstart)
+	}
+}
+
+func TestLoadInstanceTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "template.yaml")
+	config := `
+gpu_names: ["RTX 3090", "RTX 4090"]
+min_vram: 24
+max_price: 0.6
+loader: AutoGPTQ
+env:
+  HF_TOKEN: secret
+`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	template, err := LoadInstanceTemplate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(template.GPUNames) != 2 || template.Loader != "AutoGPTQ" || template.Env["HF_TOKEN"] != "secret" {
+		t.Errorf("unexpected template: %+v", template)
+	}
+	// unset fields keep their defaults
+	if template.Disk != 30 || template.NumGPUs != 1 {
+		t.Errorf("defaults not kept: %+v", template)
+	}
+	query := template.BundleQuery()
+	if query["gpu_ram"].(map[string]interface{})["gte"] != 24000.0 {
+		t.Errorf("unexpected gpu_ram filter: %v", query["gpu_ram"])
+	}
+}
@@ -1,20 +1,57 @@
 package provider
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/beyondblog/llm-api-gateway/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"log"
-	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vastAIBaseURL = "https://console.vast.ai/api/v0"
+	tracerName    = "github.com/beyondblog/llm-api-gateway/provider"
 )
 
 type VastAIProvider struct {
-	apiKey string
-	model  string
-	branch string
-	label  string
+	apiKey   string
+	model    string
+	branch   string
+	label    string
+	baseURL  string
+	template *InstanceTemplate
+	budget   *Budget
+	// reportError is told about failed api calls, it may be nil
+	reportError func(operation string, err error)
+
+	mux              sync.Mutex
+	unhealthyTimeout time.Duration
+	unhealthySince   map[int]time.Time
+
+	scaling     sync.Mutex // serializes renting and destroying instances
+	replicas    int        // replicas last asked of AutoScaling, -1 until then
+	minReplicas int        // live instances kept by renting on-demand ones when bid instances are preempted
+}
+
+type APIResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+	Msg     string `json:"msg"`
+}
+
+type CreateInstanceResponse struct {
+	APIResponse
+	NewContract int `json:"new_contract"`
 }
 
 type ExecuteCommandResponse struct {
@@ -138,79 +175,82 @@ type ExecuteCommand struct {
 }
 
 type QueryBundleResponse struct {
-	Offers []struct {
-		IsBid              bool        `json:"is_bid"`
-		InetUpBilled       interface{} `json:"inet_up_billed"`
-		InetDownBilled     interface{} `json:"inet_down_billed"`
-		External           bool        `json:"external"`
-		Webpage            interface{} `json:"webpage"`
-		Logo               string      `json:"logo"`
-		Rentable           bool        `json:"rentable"`
-		ComputeCap         int         `json:"compute_cap"`
-		CreditBalance      interface{} `json:"credit_balance"`
-		CreditDiscount     interface{} `json:"credit_discount"`
-		CreditDiscountMax  *float64    `json:"credit_discount_max"`
-		DriverVersion      string      `json:"driver_version"`
-		CudaMaxGood        float64     `json:"cuda_max_good"`
-		MachineId          int         `json:"machine_id"`
-		HostingType        *int        `json:"hosting_type"`
-		PublicIpaddr       string      `json:"public_ipaddr"`
-		Geolocation        string      `json:"geolocation"`
-		FlopsPerDphtotal   float64     `json:"flops_per_dphtotal"`
-		DlperfPerDphtotal  float64     `json:"dlperf_per_dphtotal"`
-		Reliability2       float64     `json:"reliability2"`
-		HostRunTime        float64     `json:"host_run_time"`
-		ClientRunTime      float64     `json:"client_run_time"`
-		HostId             int         `json:"host_id"`
-		Id                 int         `json:"id"`
-		BundleId           int         `json:"bundle_id"`
-		NumGpus            int         `json:"num_gpus"`
-		TotalFlops         float64     `json:"total_flops"`
-		MinBid             float64     `json:"min_bid"`
-		DphBase            float64     `json:"dph_base"`
-		DphTotal           float64     `json:"dph_total"`
-		GpuName            string      `json:"gpu_name"`
-		GpuRam             int         `json:"gpu_ram"`
-		GpuTotalram        int         `json:"gpu_totalram"`
-		VramCostperhour    float64     `json:"vram_costperhour"`
-		GpuDisplayActive   bool        `json:"gpu_display_active"`
-		GpuMemBw           float64     `json:"gpu_mem_bw"`
-		BwNvlink           float64     `json:"bw_nvlink"`
-		DirectPortCount    int         `json:"direct_port_count"`
-		GpuLanes           int         `json:"gpu_lanes"`
-		PcieBw             float64     `json:"pcie_bw"`
-		PciGen             float64     `json:"pci_gen"`
-		Dlperf             float64     `json:"dlperf"`
-		CpuName            string      `json:"cpu_name"`
-		MoboName           string      `json:"mobo_name"`
-		CpuRam             int         `json:"cpu_ram"`
-		CpuCores           int         `json:"cpu_cores"`
-		CpuCoresEffective  float64     `json:"cpu_cores_effective"`
-		GpuFrac            float64     `json:"gpu_frac"`
-		HasAvx             int         `json:"has_avx"`
-		DiskSpace          float64     `json:"disk_space"`
-		DiskName           string      `json:"disk_name"`
-		DiskBw             float64     `json:"disk_bw"`
-		InetUp             float64     `json:"inet_up"`
-		InetDown           float64     `json:"inet_down"`
-		StartDate          float64     `json:"start_date"`
-		EndDate            *float64    `json:"end_date"`
-		Duration           *float64    `json:"duration"`
-		StorageCost        float64     `json:"storage_cost"`
-		InetUpCost         float64     `json:"inet_up_cost"`
-		InetDownCost       float64     `json:"inet_down_cost"`
-		StorageTotalCost   float64     `json:"storage_total_cost"`
-		OsVersion          string      `json:"os_version"`
-		Verification       string      `json:"verification"`
-		StaticIp           bool        `json:"static_ip"`
-		Score              float64     `json:"score"`
-		DiscountRate       *float64    `json:"discount_rate"`
-		DiscountedHourly   float64     `json:"discounted_hourly"`
-		DiscountedDphTotal float64     `json:"discounted_dph_total"`
-		Rented             bool        `json:"rented"`
-		BundledResults     int         `json:"bundled_results"`
-		PendingCount       int         `json:"pending_count"`
-	} `json:"offers"`
+	Offers []Offer `json:"offers"`
+}
+
+// Offer is a machine offered for rent by the bundles search
+type Offer struct {
+	IsBid              bool        `json:"is_bid"`
+	InetUpBilled       interface{} `json:"inet_up_billed"`
+	InetDownBilled     interface{} `json:"inet_down_billed"`
+	External           bool        `json:"external"`
+	Webpage            interface{} `json:"webpage"`
+	Logo               string      `json:"logo"`
+	Rentable           bool        `json:"rentable"`
+	ComputeCap         int         `json:"compute_cap"`
+	CreditBalance      interface{} `json:"credit_balance"`
+	CreditDiscount     interface{} `json:"credit_discount"`
+	CreditDiscountMax  *float64    `json:"credit_discount_max"`
+	DriverVersion      string      `json:"driver_version"`
+	CudaMaxGood        float64     `json:"cuda_max_good"`
+	MachineId          int         `json:"machine_id"`
+	HostingType        *int        `json:"hosting_type"`
+	PublicIpaddr       string      `json:"public_ipaddr"`
+	Geolocation        string      `json:"geolocation"`
+	FlopsPerDphtotal   float64     `json:"flops_per_dphtotal"`
+	DlperfPerDphtotal  float64     `json:"dlperf_per_dphtotal"`
+	Reliability2       float64     `json:"reliability2"`
+	HostRunTime        float64     `json:"host_run_time"`
+	ClientRunTime      float64     `json:"client_run_time"`
+	HostId             int         `json:"host_id"`
+	Id                 int         `json:"id"`
+	BundleId           int         `json:"bundle_id"`
+	NumGpus            int         `json:"num_gpus"`
+	TotalFlops         float64     `json:"total_flops"`
+	MinBid             float64     `json:"min_bid"`
+	DphBase            float64     `json:"dph_base"`
+	DphTotal           float64     `json:"dph_total"`
+	GpuName            string      `json:"gpu_name"`
+	GpuRam             int         `json:"gpu_ram"`
+	GpuTotalram        int         `json:"gpu_totalram"`
+	VramCostperhour    float64     `json:"vram_costperhour"`
+	GpuDisplayActive   bool        `json:"gpu_display_active"`
+	GpuMemBw           float64     `json:"gpu_mem_bw"`
+	BwNvlink           float64     `json:"bw_nvlink"`
+	DirectPortCount    int         `json:"direct_port_count"`
+	GpuLanes           int         `json:"gpu_lanes"`
+	PcieBw             float64     `json:"pcie_bw"`
+	PciGen             float64     `json:"pci_gen"`
+	Dlperf             float64     `json:"dlperf"`
+	CpuName            string      `json:"cpu_name"`
+	MoboName           string      `json:"mobo_name"`
+	CpuRam             int         `json:"cpu_ram"`
+	CpuCores           int         `json:"cpu_cores"`
+	CpuCoresEffective  float64     `json:"cpu_cores_effective"`
+	GpuFrac            float64     `json:"gpu_frac"`
+	HasAvx             int         `json:"has_avx"`
+	DiskSpace          float64     `json:"disk_space"`
+	DiskName           string      `json:"disk_name"`
+	DiskBw             float64     `json:"disk_bw"`
+	InetUp             float64     `json:"inet_up"`
+	InetDown           float64     `json:"inet_down"`
+	StartDate          float64     `json:"start_date"`
+	EndDate            *float64    `json:"end_date"`
+	Duration           *float64    `json:"duration"`
+	StorageCost        float64     `json:"storage_cost"`
+	InetUpCost         float64     `json:"inet_up_cost"`
+	InetDownCost       float64     `json:"inet_down_cost"`
+	StorageTotalCost   float64     `json:"storage_total_cost"`
+	OsVersion          string      `json:"os_version"`
+	Verification       string      `json:"verification"`
+	StaticIp           bool        `json:"static_ip"`
+	Score              float64     `json:"score"`
+	DiscountRate       *float64    `json:"discount_rate"`
+	DiscountedHourly   float64     `json:"discounted_hourly"`
+	DiscountedDphTotal float64     `json:"discounted_dph_total"`
+	Rented             bool        `json:"rented"`
+	BundledResults     int         `json:"bundled_results"`
+	PendingCount       int         `json:"pending_count"`
 }
 
 type CreateInstanceParam struct {
@@ -236,65 +276,303 @@ func NewVastAIProvider(apiKey, model, branch, label string) *VastAIProvider {
 		branch = "main"
 	}
 	return &VastAIProvider{
-		apiKey: apiKey,
-		branch: branch,
-		model:  model,
-		label:  label,
+		apiKey:   apiKey,
+		branch:   branch,
+		model:    model,
+		label:    label,
+		baseURL:  vastAIBaseURL,
+		template: DefaultInstanceTemplate(),
+
+		unhealthySince: make(map[int]time.Time),
+		replicas:       -1,
+	}
+}
+
+// SetUnhealthyTimeout makes GetEndpoints destroy instances that keep failing the
+// health check for longer than timeout, zero disables it
+func (v *VastAIProvider) SetUnhealthyTimeout(timeout time.Duration) {
+	v.unhealthyTimeout = timeout
+}
+
+// SetInstanceTemplate replaces the template used to rent new instances
+func (v *VastAIProvider) SetInstanceTemplate(template *InstanceTemplate) {
+	v.template = template
+}
+
+// SetBackfill keeps at least minReplicas instances of an interruptible template: when preempted bid
+// instances leave fewer, GetEndpoints rents on-demand instances to make up for them, never above the
+// replicas last asked of AutoScaling. 0 disables it.
+func (v *VastAIProvider) SetBackfill(minReplicas int) {
+	v.minReplicas = minReplicas
+}
+
+// SetErrorReporter has report called with the failed instance operations, destroy, stop, start, reboot
+// and backfill, whether asked for or made on its own
+func (v *VastAIProvider) SetErrorReporter(report func(operation string, err error)) {
+	v.reportError = report
+}
+
+// failed reports err of operation when there is a reporter, it returns err
+func (v *VastAIProvider) failed(operation string, err error) error {
+	if v.reportError != nil {
+		v.reportError(operation, err)
 	}
+	return err
+}
+
+// SetBudget makes AutoScaling refuse instances that would break the spend budget, nil disables it
+func (v *VastAIProvider) SetBudget(budget *Budget) {
+	v.budget = budget
 }
 
 func (v *VastAIProvider) GetModel() string {
-	return fmt.Sprintf("%s_%s", strings.ReplaceAll(v.model, "/", "_"), v.branch)
+	return modelName(v.model, v.branch)
 }
 
 func (v *VastAIProvider) GetEndpoints() ([]ServerEndpoint, error) {
-	data, err := v.request("GET", "https://console.vast.ai/api/v0/instances", nil)
-	if err != nil {
-		return nil, err
-	}
-	var instanceResponse InstanceResponse
-	err = json.Unmarshal(data, &instanceResponse)
+	instances, err := v.liveInstances()
 	if err != nil {
 		return nil, err
 	}
 
 	var endpoints []ServerEndpoint
-	for _, instance := range instanceResponse.Instances {
-		if !strings.Contains(instance.ImageUuid, "text-generation-webui") {
-			continue
-		}
+	healthy := make(map[int]bool)
+	for _, instance := range instances {
 		// text-generation-webui check if port 5000 is open
 		if instance.Ports["5000/tcp"] == nil {
 			continue
 		}
 		port, _ := strconv.Atoi(instance.Ports["5000/tcp"][0].HostPort)
 
-		if instance.Label != v.label {
-			continue
-		}
-
 		endpoint := ServerEndpoint{
 			ID:      fmt.Sprintf("%d", instance.Id),
 			Host:    strings.TrimSpace(instance.PublicIpaddr),
 			Port:    port,
 			CPUName: instance.CpuName,
 			GPUName: instance.GpuName,
+			Model:   v.GetModel(),
+			Weight:  1,
+			Origin:  "vastai",
+
+			PricePerHour: instance.DphTotal,
 		}
 
 		if v.healthCheck(endpoint) {
 			endpoints = append(endpoints, endpoint)
+			healthy[instance.Id] = true
 		}
 
 	}
+	v.reapUnhealthy(instances, healthy)
 	return endpoints, nil
 }
 
+// reapUnhealthy destroys instances that have failed the health check for longer than unhealthyTimeout.
+// Stopped instances are paused on purpose and left alone.
+func (v *VastAIProvider) reapUnhealthy(instances []Instance, healthy map[int]bool) {
+	if v.unhealthyTimeout <= 0 {
+		return
+	}
+	v.mux.Lock()
+	now := time.Now()
+	seen := make(map[int]bool)
+	var expired []int
+	for _, instance := range instances {
+		seen[instance.Id] = true
+		if healthy[instance.Id] || instance.IntendedStatus == "stopped" {
+			delete(v.unhealthySince, instance.Id)
+			continue
+		}
+		since, ok := v.unhealthySince[instance.Id]
+		if !ok {
+			v.unhealthySince[instance.Id] = now
+			continue
+		}
+		if now.Sub(since) < v.unhealthyTimeout {
+			continue
+		}
+		log.Printf("instance %d unhealthy since %s, destroying\n", instance.Id, since.Format(time.RFC3339))
+		expired = append(expired, instance.Id)
+	}
+	for id := range v.unhealthySince {
+		if !seen[id] {
+			delete(v.unhealthySince, id)
+		}
+	}
+	v.mux.Unlock()
+
+	// the api calls run unlocked
+	for _, id := range expired {
+		if err := v.destroyInstance(id); err != nil {
+			log.Printf("reap unhealthy instance err: %v\n", err)
+			continue
+		}
+		v.mux.Lock()
+		delete(v.unhealthySince, id)
+		v.mux.Unlock()
+	}
+}
+
+// AutoScaling rents or destroys labelled text-generation-webui instances until
+// their count matches replica. Instances that are still booting are counted, so
+// calling it repeatedly with the same target does not rent more boxes.
 func (v *VastAIProvider) AutoScaling(replica int) error {
-	//TODO implement me
-	panic("implement me")
+	if replica < 0 {
+		return fmt.Errorf("invalid replica count: %d", replica)
+	}
+	v.scaling.Lock()
+	defer v.scaling.Unlock()
+	v.replicas = replica
+	instances, err := v.listInstances()
+	if err != nil {
+		return err
+	}
+	instances = v.reapPreempted(instances)
+
+	current := len(instances)
+	if current == replica {
+		return nil
+	}
+	log.Printf("autoscaling %s from %d to %d replicas\n", v.GetModel(), current, replica)
+
+	var errs []error
+	if current < replica {
+		for i := current; i < replica; i++ {
+			instanceID, err := v.createInstance(v.template)
+			if errors.Is(err, ErrBudgetExceeded) {
+				// the next instances cost at least as much
+				errs = append(errs, err)
+				break
+			}
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			log.Printf("instance %d created\n", instanceID)
+		}
+	} else {
+		// destroy instances that are not running first, then the most recently started
+		sort.SliceStable(instances, func(i, j int) bool {
+			ri, rj := instances[i].ActualStatus == "running", instances[j].ActualStatus == "running"
+			if ri != rj {
+				return !ri
+			}
+			return instances[i].StartDate > instances[j].StartDate
+		})
+		for _, instance := range instances[:current-replica] {
+			if err := v.destroyInstance(instance.Id); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			log.Printf("instance %d destroyed\n", instance.Id)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("autoscaling %s to %d replicas: %w", v.GetModel(), replica, errors.Join(errs...))
+	}
+	return nil
 }
 
-func (v *VastAIProvider) request(method, url string, payload []byte) ([]byte, error) {
+// liveInstances lists the instances, destroying the preempted ones. It rents on-demand instances while
+// fewer than the backfill minimum are left, they show up in the next listing.
+func (v *VastAIProvider) liveInstances() ([]Instance, error) {
+	v.scaling.Lock()
+	defer v.scaling.Unlock()
+	instances, err := v.listInstances()
+	if err != nil {
+		return nil, err
+	}
+	live := v.reapPreempted(instances)
+	// scaled down on purpose, by the autoscaler or the admin api, is not to be backfilled
+	wanted := min(v.minReplicas, v.replicas)
+	if !v.template.Interruptible || len(live) >= wanted {
+		return live, nil
+	}
+	missing := wanted - len(live)
+	log.Printf("%s: %d instances left, below the minimum of %d, backfilling %d on-demand\n",
+		v.GetModel(), len(live), wanted, missing)
+	for i := 0; i < missing; i++ {
+		instanceID, err := v.createInstance(v.template.onDemand())
+		if err != nil {
+			// retried on the next listing
+			log.Printf("backfill err: %v\n", v.failed("backfill", err))
+			break
+		}
+		log.Printf("instance %d created\n", instanceID)
+	}
+	return live, nil
+}
+
+// preempted returns true when vast.ai stopped a bid instance that is meant to run, because it was
+// outbid or the host reclaimed it. Instances stopped on purpose have the stopped intended status.
+func preempted(instance Instance) bool {
+	if !instance.IsBid || instance.IntendedStatus != "running" {
+		return false
+	}
+	return instance.ActualStatus == "exited" || instance.ActualStatus == "stopped"
+}
+
+// reapPreempted destroys the preempted instances, a stopped bid instance serves nothing but its disk
+// is still billed. It returns the other instances.
+func (v *VastAIProvider) reapPreempted(instances []Instance) []Instance {
+	var live []Instance
+	for _, instance := range instances {
+		if !preempted(instance) {
+			live = append(live, instance)
+			continue
+		}
+		log.Printf("instance %d preempted (%s, intended %s: %s), destroying\n", instance.Id,
+			instance.ActualStatus, instance.IntendedStatus, strings.TrimSpace(instance.StatusMsg))
+		if err := v.destroyInstance(instance.Id); err != nil {
+			log.Printf("destroy preempted instance err: %v\n", err)
+		}
+	}
+	return live
+}
+
+// listInstances returns the text-generation-webui instances carrying the provider label
+func (v *VastAIProvider) listInstances() ([]Instance, error) {
+	data, err := v.request("GET", fmt.Sprintf("%s/instances", v.baseURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	var instanceResponse InstanceResponse
+	err = json.Unmarshal(data, &instanceResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		instances []Instance
+		perHour   float64
+	)
+	for _, instance := range instanceResponse.Instances {
+		if !strings.Contains(instance.ImageUuid, "text-generation-webui") {
+			continue
+		}
+		if instance.Label != v.label {
+			continue
+		}
+		instances = append(instances, instance)
+		perHour += instance.DphTotal
+	}
+	v.budget.observe(v.label, perHour)
+	return instances, nil
+}
+
+func (v *VastAIProvider) request(method, url string, payload []byte) (data []byte, err error) {
+	_, span := otel.Tracer(tracerName).Start(context.Background(), "vastai "+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.method", method), attribute.String("http.url", url)))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	header := map[string]string{
 		"Authorization": fmt.Sprintf("Bearer %s", v.apiKey),
 	}
@@ -304,6 +582,8 @@ func (v *VastAIProvider) request(method, url string, payload []byte) ([]byte, er
 		return utils.PostHttpRequest(url, header, payload)
 	} else if method == "PUT" {
 		return utils.PutHttpRequest(url, header, payload)
+	} else if method == "DELETE" {
+		return utils.DeleteHttpRequest(url, header)
 	}
 	return nil, fmt.Errorf("unsupported method: %s", method)
 }
@@ -315,7 +595,7 @@ func (v *VastAIProvider) executeCommand(instanceID int, command string) (*Execut
 	}
 	payload, _ := json.Marshal(commandParam)
 
-	data, err := v.request("PUT", fmt.Sprintf("https://console.vast.ai/api/v0/instances/command/%d/", instanceID), payload)
+	data, err := v.request("PUT", fmt.Sprintf("%s/instances/command/%d/", v.baseURL, instanceID), payload)
 	if err != nil {
 		return nil, err
 	}
@@ -346,35 +626,31 @@ func (v *VastAIProvider) healthCheck(endpoint ServerEndpoint) bool {
 	return response.ModelName == v.GetModel()
 }
 
-func (v *VastAIProvider) createInstance() error {
-
-	diskSpace := "30"
-	gpuName := "RTX 4090"
-	dlperf := "70"
-	query := fmt.Sprintf(`{"verified": {"eq": "True"}, "external": {"eq": false}, "rentable": {"eq": true}, "rented": {"eq": false}, "disk_space": {"gte": "%s"}, "gpu_name": {"eq": "%s"}, "num_gpus": {"eq": "1"}, "reliability2": {"gt": "0.99"}, "dlperf": {"gt": "%s"}, "order": [["dphtotal", "asc"], ["total_flops", "asc"]], "type": "on-demand"}`,
-		diskSpace, gpuName, dlperf)
-	query = url.QueryEscape(query)
-	data, err := v.request("GET", fmt.Sprintf("https://console.vast.ai/api/v0/bundles?q=%s", query), nil)
+// createInstance rents the best ranked offer matching template and returns the new instance id
+func (v *VastAIProvider) createInstance(template *InstanceTemplate) (int, error) {
+	onstart, err := template.RenderOnstart(v.model, v.branch)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("render onstart: %w", err)
 	}
 
-	var response QueryBundleResponse
-	err = json.Unmarshal(data, &response)
+	offers, err := v.searchOffers(template)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("create instance: %w", err)
+	}
+	offer := offers[0]
+	log.Printf("renting %s\n", offer)
+	if err := v.budget.reserve(v.label, offer.Price); err != nil {
+		return 0, fmt.Errorf("create instance: %w", err)
 	}
-
-	log.Printf("%+v", response.Offers[0])
 
 	createParam := CreateInstanceParam{
 		ClientId:      "me",
-		Image:         "atinoda/text-generation-webui:default-snapshot-2023-12-31",
-		Env:           nil,
-		Price:         response.Offers[0].DphTotal,
-		Disk:          30.48,
-		Label:         "",
-		Onstart:       "env | grep _ >> /etc/environment; pip install accelerate -U; pip install protobuf;python3 /app/download-model.py --output /app/models --branch gptq-4bit-32g-actorder_True TheBloke/U-Amethyst-20B-GPTQ; cd /app; /scripts/docker-entrypoint.sh python3 /app/server.py --listen --api --verbose --loader ExLlamav2_HF --model TheBloke_U-Amethyst-20B-GPTQ_gptq-4bit-32g-actorder_True;",
+		Image:         template.Image,
+		Env:           template.Env,
+		Price:         offer.Price,
+		Disk:          template.Disk,
+		Label:         v.label,
+		Onstart:       onstart,
 		RunType:       "jupyter_direc ssh_direc ssh_proxy",
 		ImageLogin:    "",
 		PythonUtf8:    false,
@@ -384,16 +660,116 @@ func (v *VastAIProvider) createInstance() error {
 		CreateFrom:    "",
 		Force:         false,
 	}
-	machineID := response.Offers[0].Id
+	machineID := offer.Id
 	payload, _ := json.Marshal(createParam)
 
-	log.Printf(string(payload))
+	data, err := v.request("PUT", fmt.Sprintf("%s/asks/%d/", v.baseURL, machineID), payload)
+	if err != nil {
+		return 0, fmt.Errorf("create instance from offer %d: %w", machineID, err)
+	}
+
+	log.Println(string(data))
+	var createResponse CreateInstanceResponse
+	err = json.Unmarshal(data, &createResponse)
+	if err != nil {
+		return 0, fmt.Errorf("create instance from offer %d: %w", machineID, err)
+	}
+	if !createResponse.Success {
+		return 0, fmt.Errorf("create instance from offer %d: %s", machineID, createResponse.message())
+	}
+	return createResponse.NewContract, nil
+}
+
+// DestroyInstance destroys the instance, deleting its data and stopping all billing. The instance
+// counts as scaled down, it is not backfilled.
+func (v *VastAIProvider) DestroyInstance(id string) error {
+	instanceID, err := parseInstanceID(id)
+	if err != nil {
+		return err
+	}
+	v.scaling.Lock()
+	defer v.scaling.Unlock()
+	if err := v.destroyInstance(instanceID); err != nil {
+		return err
+	}
+	if v.replicas > 0 {
+		v.replicas--
+	}
+	return nil
+}
+
+// StopInstance stops the instance, only storage is billed while stopped
+func (v *VastAIProvider) StopInstance(id string) error {
+	instanceID, err := parseInstanceID(id)
+	if err != nil {
+		return err
+	}
+	return v.setInstanceState(instanceID, "stopped")
+}
+
+// StartInstance starts a stopped instance
+func (v *VastAIProvider) StartInstance(id string) error {
+	instanceID, err := parseInstanceID(id)
+	if err != nil {
+		return err
+	}
+	return v.setInstanceState(instanceID, "running")
+}
 
-	data, err = v.request("PUT", fmt.Sprintf("https://console.vast.ai/api/v0/asks/%d/", machineID), payload)
+// RebootInstance restarts the instance container without losing the GPU
+func (v *VastAIProvider) RebootInstance(id string) error {
+	instanceID, err := parseInstanceID(id)
 	if err != nil {
 		return err
 	}
+	return v.instanceAction("reboot", instanceID, "PUT", fmt.Sprintf("%s/instances/reboot/%d/", v.baseURL, instanceID), nil)
+}
 
-	log.Println(string(data))
+func (v *VastAIProvider) destroyInstance(instanceID int) error {
+	return v.instanceAction("destroy", instanceID, "DELETE", fmt.Sprintf("%s/instances/%d/", v.baseURL, instanceID), nil)
+}
+
+func (v *VastAIProvider) setInstanceState(instanceID int, state string) error {
+	payload, _ := json.Marshal(map[string]string{"state": state})
+	action := "start"
+	if state == "stopped" {
+		action = "stop"
+	}
+	return v.instanceAction(action, instanceID, "PUT", fmt.Sprintf("%s/instances/%d/", v.baseURL, instanceID), payload)
+}
+
+// instanceAction calls the vast.ai api and checks the success flag of the response
+func (v *VastAIProvider) instanceAction(action string, instanceID int, method, url string, payload []byte) error {
+	data, err := v.request(method, url, payload)
+	if err != nil {
+		return v.failed(action, fmt.Errorf("%s instance %d: %w", action, instanceID, err))
+	}
+
+	var response APIResponse
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return v.failed(action, fmt.Errorf("%s instance %d: %w", action, instanceID, err))
+	}
+	if !response.Success {
+		return v.failed(action, fmt.Errorf("%s instance %d: %s", action, instanceID, response.message()))
+	}
 	return nil
 }
+
+func parseInstanceID(id string) (int, error) {
+	instanceID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, fmt.Errorf("invalid vast.ai instance id: %q", id)
+	}
+	return instanceID, nil
+}
+
+func (r APIResponse) message() string {
+	if r.Msg != "" {
+		return r.Msg
+	}
+	if r.Error != "" {
+		return r.Error
+	}
+	return "request failed"
+}
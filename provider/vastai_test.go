@@ -1,8 +1,22 @@
 package provider
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestVastAIProvider_GetEndpoints(t *testing.T) {
@@ -38,5 +52,336 @@ func TestVastAI_ExecuteCommand(t *testing.T) {
 func TestVastAIProvider_AutoScaling(t *testing.T) {
 	apiKey := os.Getenv("VASTAI_API_KEY")
 	provider := NewVastAIProvider(apiKey, "TheBloke/Mixtral-8x7B-Instruct-v0.1-GPTQ", "main", "")
-	_ = provider.createInstance()
+	_, _ = provider.createInstance(provider.template)
+}
+
+// fakeVastAI is a minimal in-memory stand-in for the vast.ai console API
+type fakeVastAI struct {
+	mux       sync.Mutex
+	instances []Instance
+	created   []int
+	destroyed []int
+	actions   []string
+	failIDs   map[int]bool
+	nextID    int
+	offers    string // bundles search response, one offer when empty
+	rented    []int  // offer ids
+	prices    []float64
+	rentType  string // type of the last bundles search, on-demand or bid
+}
+
+func (f *fakeVastAI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/v0")
+	switch {
+	case r.Method == "GET" && path == "/instances":
+		_ = json.NewEncoder(w).Encode(InstanceResponse{Instances: f.instances})
+	case r.Method == "GET" && path == "/bundles":
+		var query map[string]interface{}
+		_ = json.Unmarshal([]byte(r.URL.Query().Get("q")), &query)
+		f.rentType, _ = query["type"].(string)
+		offers := f.offers
+		if offers == "" {
+			offers = `{"offers": [{"id": 42, "dph_total": 0.4}]}`
+		}
+		_, _ = w.Write([]byte(offers))
+	case r.Method == "PUT" && strings.HasPrefix(path, "/asks/"):
+		var offerID int
+		_, _ = fmt.Sscanf(path, "/asks/%d/", &offerID)
+		var param CreateInstanceParam
+		_ = json.NewDecoder(r.Body).Decode(&param)
+		f.rented = append(f.rented, offerID)
+		f.prices = append(f.prices, param.Price)
+		f.nextID++
+		f.created = append(f.created, f.nextID)
+		f.instances = append(f.instances, Instance{Id: f.nextID, ImageUuid: "atinoda/text-generation-webui", Label: "test",
+			DphTotal: 0.4, IsBid: f.rentType == "bid"})
+		_, _ = fmt.Fprintf(w, `{"success": true, "new_contract": %d}`, f.nextID)
+	case r.Method == "PUT" && strings.HasPrefix(path, "/instances/reboot/"):
+		f.actions = append(f.actions, path)
+		_, _ = w.Write([]byte(`{"success": true}`))
+	case r.Method == "PUT" && strings.HasPrefix(path, "/instances/"):
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		f.actions = append(f.actions, path+body["state"])
+		_, _ = w.Write([]byte(`{"success": true}`))
+	case r.Method == "DELETE" && strings.HasPrefix(path, "/instances/"):
+		var id int
+		_, _ = fmt.Sscanf(path, "/instances/%d/", &id)
+		if f.failIDs[id] {
+			_, _ = w.Write([]byte(`{"success": false, "msg": "no such instance"}`))
+			return
+		}
+		f.destroyed = append(f.destroyed, id)
+		for i, instance := range f.instances {
+			if instance.Id == id {
+				f.instances = append(f.instances[:i], f.instances[i+1:]...)
+				break
+			}
+		}
+		_, _ = w.Write([]byte(`{"success": true}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeVastAIProvider(t *testing.T, fake *fakeVastAI) *VastAIProvider {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	provider := NewVastAIProvider("key", "TheBloke/Mixtral-8x7B-Instruct-v0.1-GPTQ", "main", "test")
+	provider.baseURL = server.URL + "/api/v0"
+	return provider
+}
+
+func TestVastAIProvider_AutoScalingUp(t *testing.T) {
+	fake := &fakeVastAI{
+		nextID: 100,
+		instances: []Instance{
+			{Id: 1, ImageUuid: "atinoda/text-generation-webui", Label: "test", ActualStatus: "running"},
+			{Id: 2, ImageUuid: "atinoda/text-generation-webui", Label: "other"},
+			{Id: 3, ImageUuid: "pytorch/pytorch", Label: "test"},
+		},
+	}
+	provider := newFakeVastAIProvider(t, fake)
+
+	if err := provider.AutoScaling(3); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.created) != 2 {
+		t.Fatalf("created %v, want 2 instances", fake.created)
+	}
+	// a second call with the same target is a no-op
+	if err := provider.AutoScaling(3); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.created) != 2 || len(fake.destroyed) != 0 {
+		t.Fatalf("created %v destroyed %v after repeated call", fake.created, fake.destroyed)
+	}
+}
+
+func TestVastAIProvider_AutoScalingBudget(t *testing.T) {
+	fake := &fakeVastAI{
+		nextID: 100,
+		instances: []Instance{
+			{Id: 1, ImageUuid: "atinoda/text-generation-webui", Label: "test", ActualStatus: "running", DphTotal: 0.3},
+		},
+	}
+	provider := newFakeVastAIProvider(t, fake)
+	budget, err := NewBudget(BudgetConfig{MaxPerHour: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.SetBudget(budget)
+
+	// 0.3 + 0.4 fits, another 0.4 does not
+	err = provider.AutoScaling(4)
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("AutoScaling(4) err %v, want ErrBudgetExceeded", err)
+	}
+	if len(fake.created) != 1 {
+		t.Fatalf("created %v, want 1 instance", fake.created)
+	}
+	if err := provider.AutoScaling(3); !errors.Is(err, ErrBudgetExceeded) || len(fake.created) != 1 {
+		t.Fatalf("AutoScaling(3) err %v created %v, want a refusal", err, fake.created)
+	}
+	if perHour := budget.PerHour(); math.Abs(perHour-0.7) > 1e-9 {
+		t.Errorf("budget at $%.2f/hr, want $0.70/hr", perHour)
+	}
+	// scaling down is never refused
+	if err := provider.AutoScaling(1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVastAIProvider_AutoScalingDown(t *testing.T) {
+	fake := &fakeVastAI{
+		instances: []Instance{
+			{Id: 1, ImageUuid: "atinoda/text-generation-webui", Label: "test", ActualStatus: "running", StartDate: 1},
+			{Id: 2, ImageUuid: "atinoda/text-generation-webui", Label: "test", ActualStatus: "loading", StartDate: 2},
+			{Id: 3, ImageUuid: "atinoda/text-generation-webui", Label: "test", ActualStatus: "running", StartDate: 3},
+		},
+		failIDs: map[int]bool{3: true},
+	}
+	provider := newFakeVastAIProvider(t, fake)
+
+	err := provider.AutoScaling(1)
+	if err == nil {
+		t.Fatal("expected error for instance 3")
+	}
+	if !strings.Contains(err.Error(), "destroy instance 3") {
+		t.Errorf("error %q does not name the failed instance", err)
+	}
+	if len(fake.destroyed) != 1 || fake.destroyed[0] != 2 {
+		t.Errorf("destroyed %v, want [2]", fake.destroyed)
+	}
+}
+
+func TestVastAIProvider_Preemption(t *testing.T) {
+	fake := &fakeVastAI{
+		nextID: 100,
+		offers: `{"offers": [{"id": 42, "dph_total": 0.4, "min_bid": 0.15}]}`,
+		instances: []Instance{
+			{Id: 1, ImageUuid: "atinoda/text-generation-webui", Label: "test", IsBid: true, ActualStatus: "running", IntendedStatus: "running"},
+			// outbid
+			{Id: 2, ImageUuid: "atinoda/text-generation-webui", Label: "test", IsBid: true, ActualStatus: "exited", IntendedStatus: "running"},
+			{Id: 3, ImageUuid: "atinoda/text-generation-webui", Label: "test", IsBid: true, ActualStatus: "running", IntendedStatus: "running"},
+		},
+	}
+	provider := newFakeVastAIProvider(t, fake)
+	template := DefaultInstanceTemplate()
+	template.Interruptible = true
+	provider.SetInstanceTemplate(template)
+	provider.SetBackfill(2)
+
+	// instance 3 is stopped by hand, not preempted
+	if err := provider.StopInstance("3"); err != nil {
+		t.Fatal(err)
+	}
+	fake.instances[2].ActualStatus, fake.instances[2].IntendedStatus = "exited", "stopped"
+	if _, err := provider.GetEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.destroyed) != 1 || fake.destroyed[0] != 2 || len(fake.created) != 0 {
+		t.Fatalf("destroyed %v created %v, want only the preempted instance 2 destroyed", fake.destroyed, fake.created)
+	}
+
+	// scaling up bids the minimum bid of the offer
+	if err := provider.AutoScaling(3); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.created) != 1 || fake.rentType != "bid" || fake.prices[0] != 0.15 {
+		t.Fatalf("created %v with a %s search at %v, want one bid at 0.15", fake.created, fake.rentType, fake.prices)
+	}
+
+	// two preempted instances leave one, below the minimum of two: one on-demand instance backfills
+	fake.instances[0].ActualStatus = "exited"
+	fake.instances[2].ActualStatus, fake.instances[2].IntendedStatus = "exited", "running"
+	if _, err := provider.GetEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.destroyed) != 3 || len(fake.created) != 2 || fake.rentType != "on-demand" || fake.prices[1] != 0.4 {
+		t.Fatalf("destroyed %v created %v with a %s search at %v, want an on-demand backfill at 0.4",
+			fake.destroyed, fake.created, fake.rentType, fake.prices)
+	}
+
+	// a backfill that fails is retried on the next listing, without another preemption
+	var reported []string
+	provider.SetErrorReporter(func(operation string, err error) { reported = append(reported, operation) })
+	offers := fake.offers
+	fake.offers = `{"offers": []}`
+	fake.instances[0].ActualStatus, fake.instances[0].IntendedStatus = "exited", "running"
+	if _, err := provider.GetEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.destroyed) != 4 || len(fake.created) != 2 || fmt.Sprint(reported) != "[backfill]" {
+		t.Fatalf("destroyed %v created %v reported %v, want a failed backfill", fake.destroyed, fake.created, reported)
+	}
+	fake.offers = offers
+	if _, err := provider.GetEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.created) != 3 {
+		t.Fatalf("created %v, want the backfill retried", fake.created)
+	}
+
+	// scaled to zero on purpose, nothing is backfilled
+	if err := provider.AutoScaling(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.GetEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.instances) != 0 || len(fake.created) != 3 {
+		t.Errorf("instances %v created %v, want none left after scaling to zero", fake.instances, fake.created)
+	}
+}
+
+func TestVastAIProvider_Lifecycle(t *testing.T) {
+	fake := &fakeVastAI{
+		instances: []Instance{{Id: 7, ImageUuid: "atinoda/text-generation-webui", Label: "test"}},
+		failIDs:   map[int]bool{8: true},
+	}
+	provider := newFakeVastAIProvider(t, fake)
+	var reported []string
+	provider.SetErrorReporter(func(operation string, err error) { reported = append(reported, operation) })
+
+	if err := provider.StopInstance("7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.StartInstance("7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.RebootInstance("7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.DestroyInstance("7"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/instances/7/stopped", "/instances/7/running", "/instances/reboot/7/"}
+	if fmt.Sprint(fake.actions) != fmt.Sprint(want) {
+		t.Errorf("actions %v, want %v", fake.actions, want)
+	}
+	if len(fake.destroyed) != 1 || fake.destroyed[0] != 7 {
+		t.Errorf("destroyed %v, want [7]", fake.destroyed)
+	}
+
+	if err := provider.DestroyInstance("8"); err == nil || !strings.Contains(err.Error(), "no such instance") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(reported) != "[destroy]" {
+		t.Errorf("reported %v, want the failed destroy", reported)
+	}
+	if err := provider.StopInstance("abc"); err == nil {
+		t.Error("expected error for invalid id")
+	}
+}
+
+func TestVastAIProvider_ReapUnhealthy(t *testing.T) {
+	fake := &fakeVastAI{
+		instances: []Instance{
+			{Id: 9, ImageUuid: "atinoda/text-generation-webui", Label: "test", ActualStatus: "loading"},
+			// paused, not broken
+			{Id: 10, ImageUuid: "atinoda/text-generation-webui", Label: "test", ActualStatus: "exited", IntendedStatus: "stopped"},
+		},
+	}
+	provider := newFakeVastAIProvider(t, fake)
+	provider.SetUnhealthyTimeout(time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if _, err := provider.GetEndpoints(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if len(fake.destroyed) != 1 || fake.destroyed[0] != 9 {
+		t.Errorf("destroyed %v, want [9]", fake.destroyed)
+	}
+}
+
+func TestVastAIProvider_RequestSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	fake := &fakeVastAI{instances: []Instance{{Id: 7, ImageUuid: "atinoda/text-generation-webui", Label: "test"}}}
+	provider := newFakeVastAIProvider(t, fake)
+	if err := provider.StopInstance("7"); err != nil {
+		t.Fatal(err)
+	}
+	provider.baseURL = "http://127.0.0.1:1"
+	if err := provider.StopInstance("7"); err == nil {
+		t.Fatal("expected error for unreachable api")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("%d spans, want 2", len(spans))
+	}
+	if spans[0].Name() != "vastai PUT" || spans[0].Status().Code != codes.Unset {
+		t.Errorf("span %s status %v, want vastai PUT ok", spans[0].Name(), spans[0].Status())
+	}
+	if spans[1].Status().Code != codes.Error {
+		t.Errorf("failed request span status %v, want error", spans[1].Status())
+	}
 }
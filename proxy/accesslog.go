@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestID tags every request with an X-Request-ID, the one sent by the client when it is usable or a
+// generated one. It is echoed to the client and forwarded to the backend.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts ids of up to 128 letters, digits and -_.:
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SetAccessLog writes one JSON line per request to w, nil disables the access log
+func (s *Server) SetAccessLog(w io.Writer) {
+	if w == nil {
+		s.accessLog = nil
+		return
+	}
+	s.accessLog = slog.New(slog.NewJSONHandler(w, nil))
+}
+
+// requestLog collects what the handlers learn about a request for its metrics and access log line
+type requestLog struct {
+	model        string
+	requestBytes int
+	key          *APIKey
+	recorder     *usageRecorder
+	// failure is the error status and message of a response turned into an error event after the
+	// headers of a held stream went out with a 200
+	failure string
+}
+
+// getRequestLog returns the requestLog of r, a detached one outside of observe
+func getRequestLog(r *http.Request) *requestLog {
+	if entry, ok := r.Context().Value(requestLogContext).(*requestLog); ok {
+		return entry
+	}
+	return &requestLog{}
+}
+
+// observe records the metrics and the access log of every request, api, admin and rejected ones, once
+// all its attempts are done
+func (s *Server) observe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &requestLog{}
+		sw := newStatusWriter(w)
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestLogContext, entry)))
+		s.finishRequest(r, sw, entry, start)
+	})
+}
+
+// finishRequest records the metrics and the access log of a request
+func (s *Server) finishRequest(r *http.Request, w *statusWriter, entry *requestLog, start time.Time) {
+	elapsed := time.Since(start)
+	var (
+		usage   Usage
+		backend *Backend
+		retries int
+	)
+	if entry.recorder != nil {
+		usage, backend, _ = entry.recorder.result((entry.requestBytes + 3) / 4)
+		retries = entry.recorder.retryCount()
+	}
+	backendHost := ""
+	if backend != nil {
+		backendHost = backend.URL.Host
+	}
+	s.metrics.observeRequest(entry.model, backendHost, w, start)
+
+	if s.accessLog == nil {
+		return
+	}
+	keyID := ""
+	if entry.key != nil {
+		keyID = entry.key.ID()
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", r.Header.Get(requestIDHeader)),
+		slog.String("remote_addr", r.RemoteAddr),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.RequestURI()),
+		slog.Int("status", w.status),
+		slog.String("model", entry.model),
+		slog.String("backend", backendHost),
+		slog.String("api_key", keyID),
+		slog.Int("request_bytes", entry.requestBytes),
+		slog.Int64("response_bytes", w.bytes),
+		slog.Int("prompt_tokens", usage.PromptTokens),
+		slog.Int("completion_tokens", usage.CompletionTokens),
+		slog.Int("total_tokens", usage.TotalTokens),
+		slog.Int("retries", retries),
+		slog.Float64("duration", elapsed.Seconds()),
+	}
+	if entry.failure != "" {
+		attrs = append(attrs, slog.String("error", entry.failure))
+	}
+	s.accessLog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines waits for n lines to be written, the access log is written after the response
+func (b *syncBuffer) lines(t *testing.T, n int) []string {
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.mux.Lock()
+		lines := strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+		b.mux.Unlock()
+		if len(lines) >= n && lines[0] != "" {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d access log lines, want %d", len(lines), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_AccessLog(t *testing.T) {
+	// the backend drops the connection of the first completion request and echoes the request id
+	var completions int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/v1/internal/model/info" {
+			_, _ = fmt.Fprint(w, `{"model_name": "llama"}`)
+			return
+		}
+		if atomic.AddInt32(&completions, 1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"id": %q, "usage": {"prompt_tokens": 5, "completion_tokens": 7}}`,
+			r.Header.Get(requestIDHeader))
+	}))
+	t.Cleanup(backend.Close)
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+	s, server := newTestServer(t, &stubProvider{model: "llama", endpoints: []provider.ServerEndpoint{
+		{ID: "llama", Host: u.Hostname(), Port: port, Model: "llama"},
+	}})
+	var accessLog syncBuffer
+	s.SetAccessLog(&accessLog)
+
+	post := func(body, requestID string) (*http.Response, string) {
+		request, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/chat/completions", strings.NewReader(body))
+		if requestID != "" {
+			request.Header.Set(requestIDHeader, requestID)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		return response, string(data)
+	}
+
+	response, body := post(`{"model": "llama"}`, "")
+	id := response.Header.Get(requestIDHeader)
+	if len(id) != 32 {
+		t.Fatalf("generated request id %q", id)
+	}
+	if !strings.Contains(body, id) {
+		t.Errorf("backend got another request id: %s, want %s", body, id)
+	}
+	response, _ = post(`{"model": "gpt-4"}`, "client-id-1")
+	if got := response.Header.Get(requestIDHeader); got != "client-id-1" {
+		t.Errorf("request id %q, want the client one", got)
+	}
+	response, _ = post(`{"model": "gpt-4"}`, "bad id\"")
+	if got := response.Header.Get(requestIDHeader); got == "bad id\"" || got == "" {
+		t.Errorf("request id %q, want a generated one", got)
+	}
+	// requests not proxied to a backend are logged too
+	if response, err := http.Get(server.URL + "/v1/models"); err != nil {
+		t.Fatal(err)
+	} else {
+		_ = response.Body.Close()
+	}
+
+	var entries []map[string]interface{}
+	for _, line := range accessLog.lines(t, 4) {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("access log line %s: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	want := map[string]interface{}{
+		"msg": "request", "request_id": id, "method": "POST", "path": "/v1/chat/completions", "status": 200.0,
+		"model": "llama", "backend": u.Host, "prompt_tokens": 5.0, "completion_tokens": 7.0, "total_tokens": 12.0,
+		"retries": 1.0, "request_bytes": 18.0,
+	}
+	for field, value := range want {
+		if entries[0][field] != value {
+			t.Errorf("%s = %v, want %v", field, entries[0][field], value)
+		}
+	}
+	if entries[1]["request_id"] != "client-id-1" || entries[1]["status"] != 404.0 || entries[1]["backend"] != "" {
+		t.Errorf("unexpected entry for an unknown model: %v", entries[1])
+	}
+	if entries[3]["path"] != "/v1/models" || entries[3]["status"] != 200.0 || entries[3]["model"] != "" {
+		t.Errorf("unexpected entry for the model list: %v", entries[3])
+	}
+}
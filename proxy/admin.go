@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackendStatus is a backend as listed by the admin api
+type BackendStatus struct {
+	ID             string       `json:"id"`
+	Model          string       `json:"model"`
+	URL            string       `json:"url"`
+	Origin         string       `json:"origin,omitempty"`
+	GPUName        string       `json:"gpu_name,omitempty"`
+	CPUName        string       `json:"cpu_name,omitempty"`
+	Alive          bool         `json:"alive"`
+	Draining       bool         `json:"draining"`
+	Retired        bool         `json:"retired"`
+	Circuit        string       `json:"circuit"`
+	InFlight       int64        `json:"in_flight"`
+	MaxConcurrency int          `json:"max_concurrency"`
+	Weight         int          `json:"weight"`
+	PricePerHour   float64      `json:"price_per_hour"`
+	Health         HealthStatus `json:"health"`
+}
+
+// HealthStatus is the result of the last health check of a backend
+type HealthStatus struct {
+	CheckedAt *time.Time `json:"checked_at"`
+	Alive     bool       `json:"alive"`
+	ModelName string     `json:"model_name,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// BackendList is the response of GET /admin/backends
+type BackendList struct {
+	Object string          `json:"object"`
+	Data   []BackendStatus `json:"data"`
+}
+
+// adminHandler serves the /admin api
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/usage", s.usageReport)
+	mux.HandleFunc("/admin/backends", s.listBackends)
+	mux.HandleFunc("/admin/backends/", s.backendAction)
+	mux.HandleFunc("/admin/reload", s.reload)
+	mux.HandleFunc("/admin/scale", s.scale)
+	return s.adminAuthenticate(mux)
+}
+
+// adminAuthenticate only lets requests bearing the admin token through, the api is off without a token
+func (s *Server) adminAuthenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			writeError(w, http.StatusNotFound, "The admin api is disabled", "invalid_request_error", "admin_disabled")
+			return
+		}
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, "Incorrect admin token provided.", "invalid_request_error", "invalid_admin_token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireMethod replies 405 to requests not using method
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Use %s for %s", method, r.URL.Path),
+		"invalid_request_error", "method_not_allowed")
+	return false
+}
+
+func backendStatus(model string, b *Backend) BackendStatus {
+	status := BackendStatus{
+		ID:             b.ID,
+		Model:          model,
+		URL:            b.URL.String(),
+		Origin:         b.Origin,
+		GPUName:        b.GPUName,
+		CPUName:        b.CPUName,
+		Alive:          b.IsAlive(),
+		Draining:       b.IsDraining(),
+		Retired:        b.IsRetired(),
+		Circuit:        b.CircuitState().String(),
+		InFlight:       b.InFlight(),
+		MaxConcurrency: b.MaxConcurrency,
+		Weight:         b.weight(),
+		PricePerHour:   b.PricePerHour,
+	}
+	if checkedAt, err := b.LastHealthCheck(); !checkedAt.IsZero() {
+		status.Health.CheckedAt = &checkedAt
+		status.Health.Alive = err == nil
+		if err != nil {
+			status.Health.Error = err.Error()
+		}
+		if info := b.GetModelInfo(); info != nil {
+			status.Health.ModelName = info.ModelName
+		}
+	}
+	return status
+}
+
+// backendList lists the backends of every pool, or of the pool serving model
+func (s *Server) backendList(model string) BackendList {
+	list := BackendList{Object: "list", Data: []BackendStatus{}}
+	for _, pool := range s.pools {
+		if model != "" && s.route(model) != pool {
+			continue
+		}
+		for _, b := range pool.serverPool.Backends() {
+			list.Data = append(list.Data, backendStatus(pool.Name, b))
+		}
+	}
+	return list
+}
+
+// listBackends handles GET /admin/backends?model=
+func (s *Server) listBackends(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, s.backendList(r.URL.Query().Get("model")))
+}
+
+// findBackend returns the backend with the id or host:port and its pool
+func (s *Server) findBackend(id string) (*ModelPool, *Backend) {
+	for _, pool := range s.pools {
+		for _, b := range pool.serverPool.Backends() {
+			if b.ID == id || b.URL.Host == id {
+				return pool, b
+			}
+		}
+	}
+	return nil, nil
+}
+
+// backendAction handles POST /admin/backends/{id}/{down,up,drain}. A backend marked down comes back
+// with the next successful health check, up also ends draining.
+func (s *Server) backendAction(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	id, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/backends/"), "/")
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Unknown admin path %s", r.URL.Path),
+			"invalid_request_error", "not_found")
+		return
+	}
+	pool, backend := s.findBackend(id)
+	if backend == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("The backend `%s` does not exist", id),
+			"invalid_request_error", "backend_not_found")
+		return
+	}
+	serverPool := pool.serverPool
+	switch action {
+	case "down":
+		serverPool.MarkBackendStatus(backend.URL, false)
+	case "up":
+		backend.SetDraining(false)
+		if backend.breaker != nil {
+			backend.breaker.Reset()
+		}
+		serverPool.MarkBackendStatus(backend.URL, true)
+	case "drain":
+		backend.SetDraining(true)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Unknown backend action `%s`, use down, up or drain", action),
+			"invalid_request_error", "unknown_action")
+		return
+	}
+	log.Printf("[%s] %s marked %s by the admin api\n", pool.Name, backend.URL.Host, action)
+	writeJSON(w, backendStatus(pool.Name, backend))
+}
+
+// reload handles POST /admin/reload, it reloads the endpoints of every pool and lists the backends
+func (s *Server) reload(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	s.ReloadBackend()
+	writeJSON(w, s.backendList(""))
+}
+
+// ScaleResult is the response of POST /admin/scale
+type ScaleResult struct {
+	Model    string `json:"model"`
+	Replicas int    `json:"replicas"`
+}
+
+// scale handles POST /admin/scale?model=&replicas=, scaling the provider of the model
+func (s *Server) scale(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	model := r.URL.Query().Get("model")
+	if model == "" {
+		writeError(w, http.StatusBadRequest, "model is required", "invalid_request_error", "missing_model")
+		return
+	}
+	pool := s.route(model)
+	if pool == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("The model `%s` does not exist", model),
+			"invalid_request_error", "model_not_found")
+		return
+	}
+	replicas, err := strconv.Atoi(r.URL.Query().Get("replicas"))
+	if err != nil || replicas < 0 {
+		writeError(w, http.StatusBadRequest, "replicas must be a non-negative integer",
+			"invalid_request_error", "invalid_replicas")
+		return
+	}
+	if err := pool.llmProvider.AutoScaling(replicas); err != nil {
+		s.metrics.scalingError(pool.Name, err)
+		if errors.Is(err, provider.ErrBudgetExceeded) {
+			writeError(w, http.StatusConflict, err.Error(), "invalid_request_error", "budget_exceeded")
+			return
+		}
+		writeError(w, http.StatusBadGateway, err.Error(), "server_error", "scaling_failed")
+		return
+	}
+	if pool.autoscaler != nil {
+		pool.autoscaler.scaled(replicas)
+	}
+	log.Printf("[%s] scaled to %d replicas by the admin api\n", pool.Name, replicas)
+	writeJSON(w, ScaleResult{Model: pool.Name, Replicas: replicas})
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServer_Admin(t *testing.T) {
+	llama := newBackend(t, "llama")
+	llama.GPUName = "RTX 4090"
+	llamaProvider := &stubProvider{model: "llama", endpoints: []provider.ServerEndpoint{llama, newBackend(t, "llama-2")}}
+	s, server := newTestServer(t, llamaProvider)
+	s.SetAdminToken("admin-secret")
+
+	admin := func(method, path string, v interface{}) int {
+		request, _ := http.NewRequest(method, server.URL+path, nil)
+		request.Header.Set("Authorization", "Bearer admin-secret")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		data, _ := io.ReadAll(response.Body)
+		if v != nil && response.StatusCode == http.StatusOK {
+			if err := json.Unmarshal(data, v); err != nil {
+				t.Fatalf("%s %s: %v", method, path, err)
+			}
+		}
+		return response.StatusCode
+	}
+	completion := func() string {
+		response, err := http.Post(server.URL+"/v1/completions", "application/json", strings.NewReader(`{"model": "llama"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	var list BackendList
+	if status := admin("GET", "/admin/backends", &list); status != http.StatusOK {
+		t.Fatalf("list backends: status %d", status)
+	}
+	if len(list.Data) != 2 {
+		t.Fatalf("%d backends, want 2", len(list.Data))
+	}
+	first := list.Data[0]
+	if first.ID != "llama" || first.Model != "llama" || first.GPUName != "RTX 4090" || !first.Alive ||
+		first.Health.CheckedAt == nil || first.Health.ModelName != "llama" || first.MaxConcurrency != 4 {
+		t.Errorf("unexpected backend %+v", first)
+	}
+
+	var status BackendStatus
+	if code := admin("POST", "/admin/backends/llama/drain", &status); code != http.StatusOK || !status.Draining {
+		t.Fatalf("drain: status %d, %+v", code, status)
+	}
+	for i := 0; i < 3; i++ {
+		if got := completion(); got != "llama-2" {
+			t.Fatalf("request sent to draining backend %s", got)
+		}
+	}
+	if code := admin("POST", "/admin/backends/llama-2/down", &status); code != http.StatusOK || status.Alive {
+		t.Fatalf("down: status %d, %+v", code, status)
+	}
+	response, err := http.Post(server.URL+"/v1/completions", "application/json", strings.NewReader(`{"model": "llama"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status %d with every backend out, want 503", response.StatusCode)
+	}
+	if code := admin("POST", "/admin/backends/llama/up", &status); code != http.StatusOK || status.Draining || !status.Alive {
+		t.Fatalf("up: status %d, %+v", code, status)
+	}
+	if got := completion(); got != "llama" {
+		t.Errorf("request sent to %s, want the backend marked up", got)
+	}
+
+	if code := admin("POST", "/admin/scale?model=llama&replicas=3", nil); code != http.StatusOK || llamaProvider.replicas != 3 {
+		t.Errorf("scale: status %d, replicas %d", code, llamaProvider.replicas)
+	}
+	if code := admin("POST", "/admin/reload", &list); code != http.StatusOK || len(list.Data) != 2 {
+		t.Errorf("reload: status %d, %d backends", code, len(list.Data))
+	}
+
+	for path, want := range map[string]int{
+		"/admin/backends/unknown/down":          http.StatusNotFound,
+		"/admin/backends/llama/restart":         http.StatusNotFound,
+		"/admin/scale?model=gpt-4&replicas=1":   http.StatusNotFound,
+		"/admin/scale?replicas=1":               http.StatusBadRequest,
+		"/admin/scale?model=llama&replicas=-1":  http.StatusBadRequest,
+		"/admin/scale?model=llama&replicas=two": http.StatusBadRequest,
+	} {
+		if code := admin("POST", path, nil); code != want {
+			t.Errorf("POST %s: status %d, want %d", path, code, want)
+		}
+	}
+	if code := admin("GET", "/admin/reload", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/reload: status %d, want 405", code)
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/utils"
+	"net/http"
+	"strings"
+)
+
+// APIKey is a client key of the gateway, the key itself is only stored as its sha256 hash
+type APIKey struct {
+	Hash  string `json:"hash" yaml:"hash"`
+	Owner string `json:"owner" yaml:"owner"`
+	// AllowedModels lists the models and aliases the key may use, empty allows all
+	AllowedModels []string `json:"allowed_models" yaml:"allowed_models"`
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled" yaml:"enabled"`
+	// RequestsPerMinute and TokensPerMinute (prompt and completion) limit the key, 0 is unlimited
+	RequestsPerMinute int `json:"requests_per_minute" yaml:"requests_per_minute"`
+	TokensPerMinute   int `json:"tokens_per_minute" yaml:"tokens_per_minute"`
+}
+
+// IsEnabled returns false when the key has been switched off in the key file
+func (k *APIKey) IsEnabled() bool {
+	return k.Enabled == nil || *k.Enabled
+}
+
+// ID identifies the key in logs and usage reports, its owner or a hash prefix for keys without one
+func (k *APIKey) ID() string {
+	if k.Owner != "" {
+		return k.Owner
+	}
+	return k.Hash[:8]
+}
+
+// AllowsModel returns true when the key may use one of names
+func (k *APIKey) AllowsModel(names ...string) bool {
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	for _, allowed := range k.AllowedModels {
+		for _, name := range names {
+			if allowed == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// KeyStore holds the API keys allowed to use the gateway
+type KeyStore struct {
+	keys map[string]*APIKey
+}
+
+type keyFile struct {
+	Keys []*APIKey `json:"keys" yaml:"keys"`
+}
+
+// HashKey returns the hex encoded sha256 of key as stored in the key file
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadKeyStore reads the API keys from a YAML or JSON file
+func LoadKeyStore(path string) (*KeyStore, error) {
+	var file keyFile
+	if err := utils.LoadConfigFile(path, &file); err != nil {
+		return nil, err
+	}
+	store := &KeyStore{keys: make(map[string]*APIKey)}
+	for i, key := range file.Keys {
+		key.Hash = strings.ToLower(strings.TrimPrefix(key.Hash, "sha256:"))
+		if len(key.Hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("%s: key %d (%s) has no valid sha256 hash", path, i, key.Owner)
+		}
+		if _, ok := store.keys[key.Hash]; ok {
+			return nil, fmt.Errorf("%s: key %d (%s) is listed twice", path, i, key.Owner)
+		}
+		store.keys[key.Hash] = key
+	}
+	return store, nil
+}
+
+// Lookup returns the API key matching key, nil if unknown
+func (k *KeyStore) Lookup(key string) *APIKey {
+	return k.keys[HashKey(key)]
+}
+
+// GetAPIKeyFromContext returns the API key the request was authenticated with, nil without authentication
+func GetAPIKeyFromContext(r *http.Request) *APIKey {
+	if key, ok := r.Context().Value(APIKeyContext).(*APIKey); ok {
+		return key
+	}
+	return nil
+}
+
+// authenticate rejects requests without a valid bearer API key and stores the key in the request context
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.keys == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || strings.TrimSpace(token) == "" {
+			writeError(w, http.StatusUnauthorized, "You didn't provide an API key. You need to provide your API key "+
+				"in an Authorization header using Bearer auth (i.e. Authorization: Bearer YOUR_KEY).",
+				"invalid_request_error", "missing_api_key")
+			return
+		}
+		key := s.keys.Lookup(strings.TrimSpace(token))
+		if key == nil {
+			writeError(w, http.StatusUnauthorized, "Incorrect API key provided.", "invalid_request_error", "invalid_api_key")
+			return
+		}
+		if !key.IsEnabled() {
+			writeError(w, http.StatusUnauthorized, "This API key has been disabled.", "invalid_request_error", "invalid_api_key")
+			return
+		}
+		// gateway keys are not meant for the backends, which may run on rented hosts
+		r.Header.Del("Authorization")
+		getRequestLog(r).key = key
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), APIKeyContext, key)))
+	})
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestServer_Authenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	keys := fmt.Sprintf(`
+keys:
+  - hash: %s
+    owner: team-a
+  - hash: sha256:%s
+    owner: team-b
+    allowed_models: [gpt-3.5-turbo]
+  - hash: %s
+    owner: team-c
+    enabled: false
+`, HashKey("sk-a"), HashKey("sk-b"), HashKey("sk-c"))
+	if err := os.WriteFile(path, []byte(keys), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := LoadKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var forwarded string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("Authorization")
+		_, _ = fmt.Fprint(w, `{"model_name": "mixtral"}`)
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+	endpoint := provider.ServerEndpoint{ID: "mixtral", Host: u.Hostname(), Port: port}
+
+	s, server := newTestServer(t,
+		&stubProvider{model: "mixtral", endpoints: []provider.ServerEndpoint{endpoint}},
+		&stubProvider{model: "llama", endpoints: []provider.ServerEndpoint{endpoint}},
+	)
+	s.SetKeyStore(store)
+	if err := s.AddAlias("gpt-3.5-turbo", "mixtral"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key        string
+		model      string
+		statusCode int
+		code       string
+	}{
+		{"", "mixtral", http.StatusUnauthorized, "missing_api_key"},
+		{"sk-unknown", "mixtral", http.StatusUnauthorized, "invalid_api_key"},
+		{"sk-c", "mixtral", http.StatusUnauthorized, "invalid_api_key"},
+		{"sk-a", "llama", http.StatusOK, ""},
+		{"sk-b", "gpt-3.5-turbo", http.StatusOK, ""},
+		{"sk-b", "llama", http.StatusForbidden, "model_not_allowed"},
+	}
+	for _, tt := range tests {
+		forwarded = ""
+		request, _ := http.NewRequest("POST", server.URL+"/v1/completions",
+			strings.NewReader(fmt.Sprintf(`{"model": %q}`, tt.model)))
+		if tt.key != "" {
+			request.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var errorResponse ErrorResponse
+		_ = json.NewDecoder(response.Body).Decode(&errorResponse)
+		_ = response.Body.Close()
+		if response.StatusCode != tt.statusCode || errorResponse.Error.Code != tt.code {
+			t.Errorf("%s %s: got %d %q, want %d %q", tt.key, tt.model, response.StatusCode,
+				errorResponse.Error.Code, tt.statusCode, tt.code)
+		}
+		if forwarded != "" {
+			t.Errorf("%s: API key forwarded to the backend", tt.key)
+		}
+	}
+
+	// the model list only shows what the key may use
+	request, _ := http.NewRequest("GET", server.URL+"/v1/models", nil)
+	request.Header.Set("Authorization", "Bearer sk-b")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var list ModelList
+	_ = json.NewDecoder(response.Body).Decode(&list)
+	if len(list.Data) != 1 || list.Data[0].ID != "gpt-3.5-turbo" {
+		t.Errorf("unexpected models: %+v", list.Data)
+	}
+}
@@ -0,0 +1,407 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// AutoscalerConfig tunes the autoscaler of a model pool, zero fields take the defaults
+type AutoscalerConfig struct {
+	MinReplicas int
+	MaxReplicas int
+	Interval    time.Duration // between two evaluations, default 30s
+	// TargetUtilization is the share of the backend concurrency the desired replicas run at, default 0.7
+	TargetUtilization float64
+	// ScaleUpUtilization and ScaleDownUtilization bound the hysteresis band, the replicas only change when
+	// the utilization leaves it. Defaults 0.8 and 0.3.
+	ScaleUpUtilization   float64
+	ScaleDownUtilization float64
+	// MaxQueueWait scales up regardless of the utilization when a request waited longer for a backend,
+	// default 5s
+	MaxQueueWait      time.Duration
+	ScaleUpCooldown   time.Duration // after scaling before scaling up again, default 3m
+	ScaleDownCooldown time.Duration // after scaling before scaling down, default 10m
+	// ScaleToZeroAfter scales the pool to zero replicas, below MinReplicas, once no request came for this
+	// long. The next request scales it back up and is held until a backend serves it. 0 disables it.
+	ScaleToZeroAfter time.Duration
+	// ColdStartTimeout bounds how long a request is held while the pool scales up from zero, default 10m
+	ColdStartTimeout time.Duration
+}
+
+func (c AutoscalerConfig) withDefaults() AutoscalerConfig {
+	if c.Interval <= 0 {
+		c.Interval = 30 * time.Second
+	}
+	if c.TargetUtilization <= 0 {
+		c.TargetUtilization = 0.7
+	}
+	if c.ScaleUpUtilization <= 0 {
+		c.ScaleUpUtilization = 0.8
+	}
+	if c.ScaleDownUtilization <= 0 {
+		c.ScaleDownUtilization = 0.3
+	}
+	if c.MaxQueueWait <= 0 {
+		c.MaxQueueWait = 5 * time.Second
+	}
+	if c.ScaleUpCooldown <= 0 {
+		c.ScaleUpCooldown = 3 * time.Minute
+	}
+	if c.ScaleDownCooldown <= 0 {
+		c.ScaleDownCooldown = 10 * time.Minute
+	}
+	if c.ColdStartTimeout <= 0 {
+		c.ColdStartTimeout = 10 * time.Minute
+	}
+	return c
+}
+
+// Validate reports bounds the autoscaler can't work with
+func (c AutoscalerConfig) Validate() error {
+	if c.MinReplicas < 0 || c.MaxReplicas < 1 || c.MinReplicas > c.MaxReplicas {
+		return fmt.Errorf("autoscaling needs 0 <= min_replicas <= max_replicas and max_replicas >= 1")
+	}
+	if c.ScaleDownUtilization >= c.ScaleUpUtilization && c.ScaleUpUtilization > 0 {
+		return fmt.Errorf("scale down utilization must be below the scale up utilization")
+	}
+	return nil
+}
+
+// scaleInputs is what the autoscaler saw in the pool
+type scaleInputs struct {
+	Serving     int   // backends taking requests
+	InFlight    int64 // requests being served
+	Queued      int   // requests waiting for a backend
+	Capacity    int   // concurrent requests the serving backends take
+	Utilization float64
+	MaxWait     time.Duration
+}
+
+func (i scaleInputs) String() string {
+	return fmt.Sprintf("serving %d, in flight %d, queued %d, capacity %d, utilization %.2f, max wait %s",
+		i.Serving, i.InFlight, i.Queued, i.Capacity, i.Utilization, i.MaxWait.Round(time.Millisecond))
+}
+
+// coldStartPoll is how often the endpoints are reloaded while scaling up from zero
+var coldStartPoll = 5 * time.Second
+
+// wakeBackoff is the wait after a failed wake up before the next one, doubled on every failure up to
+// maxWakeBackoff
+var (
+	wakeBackoff    = 5 * time.Second
+	maxWakeBackoff = 5 * time.Minute
+)
+
+// drainPoll is how often a backend drained for a scale down is checked for in-flight requests
+var drainPoll = time.Second
+
+// Autoscaler sizes the replicas of a model pool to its load. It calls LLMProvider.AutoScaling with
+// the desired count when the utilization leaves the hysteresis band and the cooldown is over.
+type Autoscaler struct {
+	server *Server
+	pool   *ModelPool
+	config AutoscalerConfig
+	now    func() time.Time
+
+	mux       sync.Mutex
+	target    int // replicas last asked of the provider, -1 until known
+	lastScale time.Time
+	started   time.Time
+	asleep    bool // scaled to zero for being idle
+	waking    bool // scaling up from zero until a backend serves
+	// wakeErr is the error of the last wake up when it failed, the next one waits until wakeRetry
+	wakeErr      error
+	wakeFailures int
+	wakeRetry    time.Time
+}
+
+func newAutoscaler(server *Server, pool *ModelPool, config AutoscalerConfig) *Autoscaler {
+	return &Autoscaler{server: server, pool: pool, config: config.withDefaults(), now: time.Now, target: -1}
+}
+
+// Run evaluates the pool at the configured interval until it is destroyed
+func (a *Autoscaler) Run() {
+	t := time.NewTicker(a.config.Interval)
+	defer t.Stop()
+	for range t.C {
+		if a.pool.serverPool.IsClose() {
+			return
+		}
+		a.Evaluate()
+	}
+}
+
+// inputs measures the load of the pool
+func (a *Autoscaler) inputs() scaleInputs {
+	var inputs scaleInputs
+	serverPool := a.pool.serverPool
+	for _, b := range serverPool.Backends() {
+		if !b.serving() {
+			continue
+		}
+		inputs.Serving++
+		inputs.InFlight += b.InFlight()
+		if b.MaxConcurrency > 0 {
+			inputs.Capacity += b.MaxConcurrency
+		} else {
+			inputs.Capacity += defaultMaxConcurrency
+		}
+	}
+	inputs.Queued = serverPool.QueueLength()
+	inputs.MaxWait = serverPool.TakeMaxWait()
+	load := float64(inputs.InFlight) + float64(inputs.Queued)
+	switch {
+	case inputs.Capacity > 0:
+		inputs.Utilization = load / float64(inputs.Capacity)
+	case load > 0:
+		inputs.Utilization = math.Inf(1)
+	}
+	return inputs
+}
+
+// desired returns the replicas serving the load at the target utilization, within the bounds
+func (a *Autoscaler) desired(inputs scaleInputs, target int) int {
+	perReplica := float64(defaultMaxConcurrency)
+	if inputs.Serving > 0 {
+		perReplica = float64(inputs.Capacity) / float64(inputs.Serving)
+	}
+	load := float64(inputs.InFlight) + float64(inputs.Queued)
+	desired := int(math.Ceil(load / (perReplica * a.config.TargetUtilization)))
+	if inputs.MaxWait > a.config.MaxQueueWait && desired <= target {
+		desired = target + 1
+	}
+	// zero replicas are only for idle pools with ScaleToZeroAfter, nothing would scale the pool back up
+	return min(max(desired, a.config.MinReplicas, 1), a.config.MaxReplicas)
+}
+
+// Evaluate measures the pool and scales it when needed, it returns the replicas asked of the provider
+func (a *Autoscaler) Evaluate() int {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	inputs := a.inputs()
+	now := a.now()
+	a.init(now)
+	target := a.target
+	desired := a.desired(inputs, target)
+	sinceScale := now.Sub(a.lastScale)
+	idle := now.Sub(a.started)
+	if lastActive := a.pool.serverPool.LastActive(); lastActive.After(a.started) {
+		idle = now.Sub(lastActive)
+	}
+	busy := inputs.InFlight > 0 || inputs.Queued > 0
+
+	action, reason := "hold", "within the hysteresis band"
+	next := target
+	switch {
+	case a.asleep || a.waking:
+		// requests wake the pool up, see wake
+		desired = target
+		reason = "scaled to zero"
+		if a.waking {
+			reason = "waking up from zero"
+		}
+	case a.config.ScaleToZeroAfter > 0 && !busy && idle >= a.config.ScaleToZeroAfter:
+		desired = 0
+		reason = fmt.Sprintf("idle for %s", idle.Round(time.Second))
+		if target > 0 {
+			action, next = "scale to zero", 0
+		}
+	case desired == target:
+		reason = "at the desired replicas"
+	case target < a.config.MinReplicas || target > a.config.MaxReplicas:
+		action, reason, next = "scale", "outside the replica bounds", desired
+	case desired > target:
+		switch {
+		case inputs.Utilization < a.config.ScaleUpUtilization && inputs.MaxWait <= a.config.MaxQueueWait:
+		case sinceScale < a.config.ScaleUpCooldown:
+			reason = fmt.Sprintf("scale up cooldown, %s left", (a.config.ScaleUpCooldown - sinceScale).Round(time.Second))
+		case inputs.MaxWait > a.config.MaxQueueWait:
+			action, reason, next = "scale up", "queue wait above the max", desired
+		default:
+			action, reason, next = "scale up", "load above the band", desired
+		}
+	case desired < target:
+		switch {
+		case inputs.Utilization > a.config.ScaleDownUtilization || inputs.Queued > 0:
+		case sinceScale < a.config.ScaleDownCooldown:
+			reason = fmt.Sprintf("scale down cooldown, %s left", (a.config.ScaleDownCooldown - sinceScale).Round(time.Second))
+		default:
+			// one replica at a time, the load of the removed one moves to the others
+			action, reason, next = "scale down", "load below the band", target-1
+		}
+	}
+	log.Printf("[%s] autoscaler: %s %d -> %d (desired %d, %s): %s\n",
+		a.pool.Name, action, target, next, desired, inputs, reason)
+	a.server.metrics.desiredReplicas.WithLabelValues(a.pool.Name).Set(float64(desired))
+	if next == target {
+		return target
+	}
+	if next == target-1 {
+		if victim := a.drainVictim(); victim != nil {
+			// the backend takes no new requests, its instance goes once the in-flight ones are done
+			victim.SetDraining(true)
+			a.target = next
+			a.lastScale = now
+			a.asleep = next == 0 && a.config.ScaleToZeroAfter > 0
+			if victim.InFlight() == 0 {
+				a.remove(victim, next)
+			} else {
+				log.Printf("[%s] autoscaler: draining %s before removing it\n", a.pool.Name, victim.URL.Host)
+				go a.removeDrained(victim, next)
+			}
+			return next
+		}
+	}
+
+	if err := a.pool.llmProvider.AutoScaling(next); err != nil {
+		log.Printf("[%s] autoscaler: AutoScaling(%d) err: %v\n", a.pool.Name, next, err)
+		a.server.metrics.scalingError(a.pool.Name, err)
+		return target
+	}
+	a.target = next
+	a.lastScale = now
+	a.asleep = next == 0 && a.config.ScaleToZeroAfter > 0
+	if a.asleep {
+		// the instances are gone, requests are held from now on instead of failing on dead backends
+		a.pool.serverPool.Sync(nil)
+	}
+	return next
+}
+
+// drainVictim picks the serving backend with the fewest in-flight requests to remove, nil when none serves
+func (a *Autoscaler) drainVictim() *Backend {
+	var victim *Backend
+	for _, b := range a.pool.serverPool.Backends() {
+		if b.serving() && (victim == nil || b.InFlight() < victim.InFlight()) {
+			victim = b
+		}
+	}
+	return victim
+}
+
+// removeDrained waits for the in-flight requests of the drained victim to finish, then removes it
+func (a *Autoscaler) removeDrained(victim *Backend, replicas int) {
+	for victim.InFlight() > 0 && !a.pool.serverPool.IsClose() {
+		time.Sleep(drainPoll)
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.remove(victim, replicas)
+}
+
+// remove destroys the instance of the drained victim and drops it from the pool. Providers that can't
+// destroy a given instance are scaled to replicas instead, the next reload brings the victim back when
+// the provider removed another one. a must be locked.
+func (a *Autoscaler) remove(victim *Backend, replicas int) {
+	err := a.pool.llmProvider.DestroyInstance(victim.ID)
+	if errors.Is(err, provider.ErrNotSupported) {
+		err = a.pool.llmProvider.AutoScaling(replicas)
+	}
+	if err != nil {
+		log.Printf("[%s] autoscaler: removing %s err: %v\n", a.pool.Name, victim.URL.Host, err)
+		a.server.metrics.scalingError(a.pool.Name, err)
+		victim.SetDraining(false)
+		if a.target == replicas {
+			a.target = replicas + 1
+			a.asleep = false
+		}
+		return
+	}
+	log.Printf("[%s] autoscaler: %s removed\n", a.pool.Name, victim.URL.Host)
+	victim.setRetired(true)
+	a.pool.serverPool.removeDrained(victim)
+}
+
+// init takes the replicas from the pool until the autoscaler asked the provider for some, a must be locked
+func (a *Autoscaler) init(now time.Time) {
+	if a.target >= 0 {
+		return
+	}
+	a.target = len(a.pool.serverPool.Backends())
+	a.started = now
+	a.asleep = a.target == 0 && a.config.ScaleToZeroAfter > 0
+}
+
+// coldStart returns true when the pool is scaled to zero, or scaling up from it, and requests are to be
+// held until a backend serves them
+func (a *Autoscaler) coldStart() bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.init(a.now())
+	return a.config.ScaleToZeroAfter > 0 && (a.target == 0 || a.asleep || a.waking)
+}
+
+// wake scales a pool at zero replicas back up for a request and reloads its endpoints until a backend
+// serves or the cold start timeout passes. It returns the error of the last wake up when it failed, the
+// next one waits for a backoff.
+func (a *Autoscaler) wake() error {
+	a.mux.Lock()
+	now := a.now()
+	a.init(now)
+	if a.waking || !(a.target == 0 || a.asleep) || now.Before(a.wakeRetry) {
+		err := a.wakeErr
+		a.mux.Unlock()
+		return err
+	}
+	a.waking = true
+	err := a.wakeErr
+	replicas := max(a.config.MinReplicas, 1)
+	a.mux.Unlock()
+
+	go func() {
+		log.Printf("[%s] autoscaler: wake up 0 -> %d: request for a pool scaled to zero\n", a.pool.Name, replicas)
+		err := a.pool.llmProvider.AutoScaling(replicas)
+		a.mux.Lock()
+		if err == nil {
+			a.target = replicas
+			a.lastScale = a.now()
+			a.asleep = false
+			a.wakeErr, a.wakeFailures = nil, 0
+		} else {
+			a.wakeErr = err
+			a.wakeFailures++
+			backoff := wakeBackoff
+			for i := 1; i < a.wakeFailures && backoff < maxWakeBackoff; i++ {
+				backoff *= 2
+			}
+			backoff = min(backoff, maxWakeBackoff)
+			a.wakeRetry = a.now().Add(backoff)
+			log.Printf("[%s] autoscaler: AutoScaling(%d) err: %v, next wake up in %s\n", a.pool.Name, replicas, err, backoff)
+		}
+		a.mux.Unlock()
+		if err != nil {
+			a.server.metrics.scalingError(a.pool.Name, err)
+		} else {
+			a.awaitBackend()
+		}
+		a.mux.Lock()
+		a.waking = false
+		a.mux.Unlock()
+	}()
+	return err
+}
+
+// awaitBackend reloads the endpoints of the pool until one serves, new instances take minutes to boot
+func (a *Autoscaler) awaitBackend() {
+	deadline := time.Now().Add(a.config.ColdStartTimeout)
+	for !a.pool.serverPool.Serving() && time.Now().Before(deadline) && !a.pool.serverPool.IsClose() {
+		a.server.reloadPool(a.pool)
+		if a.pool.serverPool.Serving() {
+			return
+		}
+		time.Sleep(coldStartPoll)
+	}
+}
+
+// scaled notes replicas set outside the autoscaler, e.g. by the admin api
+func (a *Autoscaler) scaled(replicas int) {
+	a.mux.Lock()
+	a.target = replicas
+	a.lastScale = a.now()
+	a.mux.Unlock()
+}
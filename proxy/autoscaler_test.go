@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAutoscaler(t *testing.T) {
+	llmProvider := &stubProvider{model: "llama"}
+	s := NewProxyServer(llmProvider)
+	serverPool := s.pools[0].serverPool
+	backends := newTestBackends(1, 1)
+	for _, b := range backends {
+		b.MaxConcurrency = 4
+		serverPool.AddBackend(b)
+	}
+	if err := s.SetAutoscaling("llama", AutoscalerConfig{MinReplicas: 1, MaxReplicas: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetAutoscaling("llama", AutoscalerConfig{MinReplicas: 3, MaxReplicas: 2}); err == nil {
+		t.Error("expected error for min_replicas above max_replicas")
+	}
+	autoscaler := s.pools[0].autoscaler
+	now := time.Unix(0, 0)
+	autoscaler.now = func() time.Time { return now }
+	load := func(inFlight ...int) {
+		for i, b := range backends {
+			for b.InFlight() < int64(inFlight[i]) {
+				b.IncInFlight()
+			}
+			for b.InFlight() > int64(inFlight[i]) {
+				b.DecInFlight()
+			}
+		}
+	}
+
+	steps := []struct {
+		name     string
+		advance  time.Duration
+		inFlight []int
+		wait     time.Duration
+		replicas int
+	}{
+		{"within the band", 0, []int{3, 2}, 0, 2},                         // utilization 0.62
+		{"above the band", 0, []int{4, 4}, 0, 3},                          // utilization 1, 8 requests at 0.7 of 4 per replica
+		{"up cooldown", time.Minute, []int{4, 4}, 10 * time.Second, 3},    // 3m cooldown
+		{"queue wait", 2 * time.Minute, []int{4, 4}, 10 * time.Second, 4}, // a long wait adds a replica
+		{"below the band", time.Minute, []int{1, 0}, 0, 4},                // 10m down cooldown
+		{"down after cooldown", 10 * time.Minute, []int{1, 0}, 0, 3},
+		{"one at a time", 10 * time.Minute, []int{0, 0}, 0, 2},
+		{"min replicas", 10 * time.Minute, []int{0, 0}, 0, 1},
+		{"at min replicas", 10 * time.Minute, []int{0, 0}, 0, 1},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		load(step.inFlight...)
+		serverPool.observeWait(step.wait)
+		if replicas := autoscaler.Evaluate(); replicas != step.replicas {
+			t.Fatalf("%s: %d replicas, want %d", step.name, replicas, step.replicas)
+		}
+		if llmProvider.replicas != 0 && llmProvider.replicas != step.replicas {
+			t.Fatalf("%s: provider scaled to %d, want %d", step.name, llmProvider.replicas, step.replicas)
+		}
+	}
+
+	// the admin api resets the cooldown
+	autoscaler.scaled(4)
+	now = now.Add(time.Minute)
+	if replicas := autoscaler.Evaluate(); replicas != 4 {
+		t.Errorf("%d replicas right after scaling by hand, want 4", replicas)
+	}
+}
+
+// destroyProvider records the instances destroyed
+type destroyProvider struct {
+	stubProvider
+	mux       sync.Mutex
+	destroyed []string
+}
+
+func (d *destroyProvider) DestroyInstance(id string) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.destroyed = append(d.destroyed, id)
+	return nil
+}
+
+func (d *destroyProvider) destroyedIDs() []string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return slices.Clone(d.destroyed)
+}
+
+func TestAutoscaler_DrainsScaleDown(t *testing.T) {
+	defer func(poll time.Duration) { drainPoll = poll }(drainPoll)
+	drainPoll = 10 * time.Millisecond
+
+	llmProvider := &destroyProvider{stubProvider: stubProvider{model: "llama"}}
+	s := NewProxyServer(llmProvider)
+	serverPool := s.pools[0].serverPool
+	backends := newTestBackends(1, 1)
+	for i, b := range backends {
+		b.ID = []string{"a", "b"}[i]
+		b.MaxConcurrency = 4
+		b.IncInFlight()
+		serverPool.AddBackend(b)
+	}
+	if err := s.SetAutoscaling("llama", AutoscalerConfig{MinReplicas: 1, MaxReplicas: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	// utilization 0.25, the backend goes once its request is done
+	if replicas := s.pools[0].autoscaler.Evaluate(); replicas != 1 {
+		t.Fatalf("%d replicas, want 1", replicas)
+	}
+	if !backends[0].IsDraining() || backends[1].IsDraining() {
+		t.Fatalf("backend a is not the one draining")
+	}
+	time.Sleep(5 * drainPoll)
+	if destroyed := llmProvider.destroyedIDs(); len(destroyed) != 0 {
+		t.Fatalf("destroyed %v with a request in flight", destroyed)
+	}
+
+	backends[0].DecInFlight()
+	deadline := time.Now().Add(time.Second)
+	for len(serverPool.Backends()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+	}
+	if destroyed := llmProvider.destroyedIDs(); !slices.Equal(destroyed, []string{"a"}) {
+		t.Fatalf("destroyed %v, want [a]", destroyed)
+	}
+	if pool := serverPool.Backends(); len(pool) != 1 || pool[0] != backends[1] {
+		t.Errorf("removed backend is still in the pool")
+	}
+}
+
+func TestAutoscaler_KeepsOneReplica(t *testing.T) {
+	// without scale to zero an idle pool keeps a replica, no request would scale it back up
+	llmProvider := &stubProvider{model: "llama"}
+	s := NewProxyServer(llmProvider)
+	for _, b := range newTestBackends(1, 1) {
+		s.pools[0].serverPool.AddBackend(b)
+	}
+	if err := s.SetAutoscaling("llama", AutoscalerConfig{MaxReplicas: 4}); err != nil {
+		t.Fatal(err)
+	}
+	autoscaler := s.pools[0].autoscaler
+	now := time.Unix(0, 0)
+	autoscaler.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Hour)
+		autoscaler.Evaluate()
+	}
+	if replicas := autoscaler.Evaluate(); replicas != 1 || llmProvider.replicas != 1 {
+		t.Errorf("%d replicas, provider scaled to %d, want 1", replicas, llmProvider.replicas)
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	BalancerRoundRobin       = "round_robin"
+	BalancerLeastOutstanding = "least_outstanding"
+)
+
+// Balancer picks the backend for the next request. Next is called with the pool lock held,
+// so implementations don't need their own locking.
+type Balancer interface {
+	Next(backends []*Backend) *Backend
+}
+
+// NewBalancer returns a new balancer of the named strategy
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case BalancerRoundRobin, "":
+		return new(RoundRobinBalancer), nil
+	case BalancerLeastOutstanding:
+		return new(LeastOutstandingBalancer), nil
+	}
+	return nil, fmt.Errorf("unknown balancer: %s", name)
+}
+
+// RoundRobinBalancer picks alive backends by smooth weighted round-robin,
+// equal weights give plain round-robin
+type RoundRobinBalancer struct{}
+
+func (RoundRobinBalancer) Next(backends []*Backend) *Backend {
+	var best *Backend
+	total := 0
+	for _, b := range backends {
+		if !b.IsAlive() {
+			continue
+		}
+		weight := b.weight()
+		b.currentWeight += weight
+		total += weight
+		if best == nil || b.currentWeight > best.currentWeight {
+			best = b
+		}
+	}
+	if best != nil {
+		best.currentWeight -= total
+	}
+	return best
+}
+
+// LeastOutstandingBalancer picks the alive backend with the fewest in-flight requests relative to
+// its weight, ties are broken round-robin
+type LeastOutstandingBalancer struct {
+	next uint64
+}
+
+func (l *LeastOutstandingBalancer) Next(backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	var best *Backend
+	var bestInFlight int64
+	start := int(atomic.AddUint64(&l.next, 1) % uint64(len(backends)))
+	for i := 0; i < len(backends); i++ {
+		b := backends[(start+i)%len(backends)]
+		if !b.IsAlive() {
+			continue
+		}
+		inFlight := b.InFlight()
+		// inFlight / weight < bestInFlight / best.weight without dividing
+		if best == nil || inFlight*int64(best.weight()) < bestInFlight*int64(b.weight()) {
+			best = b
+			bestInFlight = inFlight
+		}
+	}
+	return best
+}
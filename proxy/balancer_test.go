@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func newTestBackends(weights ...int) []*Backend {
+	var backends []*Backend
+	for i, weight := range weights {
+		backends = append(backends, &Backend{
+			URL:    &url.URL{Scheme: "http", Host: fmt.Sprintf("backend-%d", i)},
+			Alive:  true,
+			Weight: weight,
+		})
+	}
+	return backends
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	backends := newTestBackends(1, 2, 1)
+	backends[2].SetAlive(false)
+	balancer, _ := NewBalancer(BalancerRoundRobin)
+
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		counts[balancer.Next(backends).URL.Host]++
+	}
+	if counts["backend-0"] != 10 || counts["backend-1"] != 20 || counts["backend-2"] != 0 {
+		t.Errorf("unexpected distribution: %v", counts)
+	}
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+	backends := newTestBackends(1, 1, 2)
+	balancer, _ := NewBalancer(BalancerLeastOutstanding)
+
+	backends[0].IncInFlight()
+	backends[1].IncInFlight()
+	backends[1].IncInFlight()
+	backends[2].IncInFlight()
+	backends[2].IncInFlight()
+	backends[2].IncInFlight()
+	// backend-2 serves 1.5 requests per weight, backend-0 only 1
+	if b := balancer.Next(backends); b != backends[0] {
+		t.Errorf("picked %s, want backend-0", b.URL.Host)
+	}
+
+	backends[0].SetAlive(false)
+	if b := balancer.Next(backends); b != backends[2] {
+		t.Errorf("picked %s, want backend-2", b.URL.Host)
+	}
+
+	// equal load is spread instead of always hitting the first backend
+	idle := newTestBackends(1, 1, 1)
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		counts[balancer.Next(idle).URL.Host]++
+	}
+	if len(counts) != 3 {
+		t.Errorf("unexpected distribution: %v", counts)
+	}
+
+	for _, b := range backends {
+		b.SetAlive(false)
+	}
+	if b := balancer.Next(backends); b != nil {
+		t.Errorf("picked %s from dead backends", b.URL.Host)
+	}
+}
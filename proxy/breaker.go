@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 10 * time.Second
+)
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // requests flow
+	BreakerOpen                         // requests are held off until the cooldown is over
+	BreakerHalfOpen                     // a single probe request is let through
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker takes a backend out of rotation after consecutive failures of live requests. After
+// the cooldown one probe request is let through, its success closes the breaker, its failure opens
+// it again.
+type CircuitBreaker struct {
+	mux       sync.Mutex
+	state     BreakerState
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	probing   bool
+
+	now      func() time.Time
+	onChange func(from, to BreakerState)
+}
+
+// NewCircuitBreaker opens after threshold consecutive failures for cooldown, onChange is called
+// on every transition without the breaker lock held and may be nil
+func NewCircuitBreaker(threshold int, cooldown time.Duration, onChange func(from, to BreakerState)) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now, onChange: onChange}
+}
+
+// State returns the current state, an open breaker past its cooldown reports half-open
+func (c *CircuitBreaker) State() BreakerState {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.state == BreakerOpen && c.now().Sub(c.openedAt) >= c.cooldown {
+		return BreakerHalfOpen
+	}
+	return c.state
+}
+
+// Ready returns true when a request may be sent, it doesn't claim the probe of a half-open breaker
+func (c *CircuitBreaker) Ready() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	switch c.state {
+	case BreakerOpen:
+		return c.now().Sub(c.openedAt) >= c.cooldown
+	case BreakerHalfOpen:
+		return !c.probing
+	}
+	return true
+}
+
+// Begin notes a request sent to the backend, claiming the probe once the cooldown is over
+func (c *CircuitBreaker) Begin() {
+	c.mux.Lock()
+	from := c.state
+	if c.state == BreakerOpen && c.now().Sub(c.openedAt) >= c.cooldown {
+		c.state = BreakerHalfOpen
+	}
+	if c.state == BreakerHalfOpen {
+		c.probing = true
+	}
+	c.unlock(from)
+}
+
+// Success records a request the backend served, closing the breaker
+func (c *CircuitBreaker) Success() {
+	c.mux.Lock()
+	from := c.state
+	c.failures = 0
+	c.probing = false
+	c.state = BreakerClosed
+	c.unlock(from)
+}
+
+// Failure records a request the backend failed, opening the breaker after threshold
+// consecutive failures or when the probe failed
+func (c *CircuitBreaker) Failure() {
+	c.mux.Lock()
+	from := c.state
+	c.failures++
+	if c.state == BreakerHalfOpen || c.failures >= c.threshold {
+		c.state = BreakerOpen
+		c.openedAt = c.now()
+		c.probing = false
+	}
+	c.unlock(from)
+}
+
+// Cancel releases the probe of a request that ended without an outcome, e.g. the client went away
+func (c *CircuitBreaker) Cancel() {
+	c.mux.Lock()
+	c.probing = false
+	c.mux.Unlock()
+}
+
+// Reset closes the breaker and forgets the failures
+func (c *CircuitBreaker) Reset() {
+	c.Success()
+}
+
+// unlock releases the lock and reports a transition from the state from
+func (c *CircuitBreaker) unlock(from BreakerState) {
+	to := c.state
+	c.mux.Unlock()
+	if from != to && c.onChange != nil {
+		c.onChange(from, to)
+	}
+}
+
+// CircuitState returns the state of the circuit breaker of the backend, closed when it has none
+func (b *Backend) CircuitState() BreakerState {
+	if b.breaker == nil {
+		return BreakerClosed
+	}
+	return b.breaker.State()
+}
+
+func (b *Backend) breakerReady() bool {
+	return b.breaker == nil || b.breaker.Ready()
+}
+
+func (b *Backend) breakerBegin() {
+	if b.breaker != nil {
+		b.breaker.Begin()
+	}
+}
+
+// breakerResult records the outcome of a request to the backend
+func (b *Backend) breakerResult(ok bool) {
+	switch {
+	case b.breaker == nil:
+	case ok:
+		b.breaker.Success()
+	default:
+		b.breaker.Failure()
+	}
+}
+
+func (b *Backend) breakerCancel() {
+	if b.breaker != nil {
+		b.breaker.Cancel()
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	var transitions []string
+	breaker := NewCircuitBreaker(3, 10*time.Second, func(from, to BreakerState) {
+		transitions = append(transitions, fmt.Sprintf("%s->%s", from, to))
+	})
+	breaker.now = func() time.Time { return now }
+
+	breaker.Failure()
+	breaker.Failure()
+	breaker.Success()
+	breaker.Failure()
+	breaker.Failure()
+	if breaker.State() != BreakerClosed || !breaker.Ready() {
+		t.Fatalf("breaker %s after non-consecutive failures, want closed", breaker.State())
+	}
+	breaker.Failure()
+	if breaker.State() != BreakerOpen || breaker.Ready() {
+		t.Fatalf("breaker %s after 3 consecutive failures, want open", breaker.State())
+	}
+
+	now = now.Add(10 * time.Second)
+	if !breaker.Ready() {
+		t.Fatal("breaker not ready after the cooldown")
+	}
+	breaker.Begin()
+	if breaker.State() != BreakerHalfOpen || breaker.Ready() {
+		t.Fatalf("breaker %s lets a second probe through", breaker.State())
+	}
+	breaker.Failure()
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("breaker %s after a failed probe, want open", breaker.State())
+	}
+
+	now = now.Add(10 * time.Second)
+	breaker.Begin()
+	breaker.Cancel()
+	if !breaker.Ready() {
+		t.Fatal("canceled probe still claimed")
+	}
+	breaker.Begin()
+	breaker.Success()
+	if breaker.State() != BreakerClosed {
+		t.Fatalf("breaker %s after a successful probe, want closed", breaker.State())
+	}
+
+	want := "[closed->open open->half-open half-open->open open->half-open half-open->closed]"
+	if fmt.Sprint(transitions) != want {
+		t.Errorf("transitions %v, want %s", transitions, want)
+	}
+}
+
+func TestServer_CircuitBreaker(t *testing.T) {
+	// the flaky backend fails completions until healthy is set
+	var healthy int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/v1/internal/model/info" {
+			_, _ = fmt.Fprint(w, `{"model_name": "llama"}`)
+			return
+		}
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = fmt.Fprint(w, "flaky")
+	}))
+	t.Cleanup(flaky.Close)
+	u, _ := url.Parse(flaky.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	s := NewProxyServer(&stubProvider{model: "llama", endpoints: []provider.ServerEndpoint{
+		{ID: "flaky", Host: u.Hostname(), Port: port},
+		newBackend(t, "stable"),
+	}})
+	s.SetCircuitBreaker(2, 200*time.Millisecond)
+	s.ReloadBackend()
+	t.Cleanup(s.pools[0].serverPool.Destroy)
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+	completion := func() string {
+		response, err := http.Post(server.URL+"/v1/completions", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	flakyBackend := s.pools[0].serverPool.Backends()[0]
+	for i := 0; i < 4; i++ {
+		completion()
+	}
+	if state := flakyBackend.CircuitState(); state != BreakerOpen {
+		t.Fatalf("circuit %s after failed requests, want open", state)
+	}
+	for i := 0; i < 4; i++ {
+		if got := completion(); got != "stable" {
+			t.Fatalf("request sent to %q while the circuit is open", got)
+		}
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(200 * time.Millisecond)
+	served := map[string]int{}
+	for i := 0; i < 4; i++ {
+		served[completion()]++
+	}
+	if flakyBackend.CircuitState() != BreakerClosed || served["flaky"] == 0 {
+		t.Errorf("circuit %s after the cooldown, served %v", flakyBackend.CircuitState(), served)
+	}
+	if !flakyBackend.IsAlive() {
+		t.Error("backend with a circuit breaker marked down")
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"net/http"
+	"time"
+)
+
+var ErrColdStartTimeout = errors.New("timed out waiting for a backend to start")
+
+var (
+	// coldStartCheck is how often a held request looks for a serving backend
+	coldStartCheck = 250 * time.Millisecond
+	// coldStartKeepAlive is how often a held stream gets an SSE comment so proxies keep it open
+	coldStartKeepAlive = 15 * time.Second
+)
+
+// holdColdStart holds a request for a pool scaled to zero until a backend serves it. Streamed requests
+// get their headers and an SSE comment every coldStartKeepAlive while held, the returned writer
+// continues such a stream. The error is ErrColdStartTimeout, the error of the request context, or an
+// ErrBudgetExceeded error right away when the budget refused the wake up.
+func (s *Server) holdColdStart(w http.ResponseWriter, r *http.Request, pool *ModelPool, stream bool) (http.ResponseWriter, error) {
+	autoscaler := pool.autoscaler
+	deadline := time.NewTimer(autoscaler.config.ColdStartTimeout)
+	defer deadline.Stop()
+	check := time.NewTicker(coldStartCheck)
+	defer check.Stop()
+	keepAlive := time.NewTicker(coldStartKeepAlive)
+	defer keepAlive.Stop()
+
+	var held *heldStreamWriter
+	for {
+		// the provider may have failed to scale up, try again after the backoff
+		err := autoscaler.wake()
+		if pool.serverPool.Serving() {
+			if held != nil {
+				return held, nil
+			}
+			return w, nil
+		}
+		if errors.Is(err, provider.ErrBudgetExceeded) {
+			// no instance can be rented until the spend goes down, don't hold the request for it
+			if held != nil {
+				return held, err
+			}
+			return w, err
+		}
+		select {
+		case <-check.C:
+		case <-keepAlive.C:
+			if !stream {
+				continue
+			}
+			if held == nil {
+				held = newHeldStreamWriter(w, getRequestLog(r))
+			}
+			held.keepAlive()
+		case <-deadline.C:
+			if held != nil {
+				return held, ErrColdStartTimeout
+			}
+			return w, ErrColdStartTimeout
+		case <-r.Context().Done():
+			return w, r.Context().Err()
+		}
+	}
+}
+
+// heldStreamWriter continues an SSE response whose headers were sent while the request was held. The
+// headers and status of the real response are dropped, an error response becomes an error event
+// and its status and message the failure of the access log entry.
+type heldStreamWriter struct {
+	http.ResponseWriter
+	header http.Header
+	entry  *requestLog
+	failed bool
+}
+
+func newHeldStreamWriter(w http.ResponseWriter, entry *requestLog) *heldStreamWriter {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	return &heldStreamWriter{ResponseWriter: w, header: make(http.Header), entry: entry}
+}
+
+func (w *heldStreamWriter) keepAlive() {
+	_, _ = w.ResponseWriter.Write([]byte(": waiting for a backend to start\n\n"))
+	w.Flush()
+}
+
+func (w *heldStreamWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *heldStreamWriter) WriteHeader(statusCode int) {
+	w.failed = statusCode >= http.StatusBadRequest
+	if w.failed {
+		w.entry.failure = fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode))
+	}
+}
+
+func (w *heldStreamWriter) Write(p []byte) (int, error) {
+	if !w.failed {
+		return w.ResponseWriter.Write(p)
+	}
+	// the error body, an OpenAI error in most cases, is the data of the event
+	var response ErrorResponse
+	if json.Unmarshal(bytes.TrimSpace(p), &response) == nil && response.Error.Message != "" {
+		w.entry.failure += ": " + response.Error.Message
+	}
+	_, err := fmt.Fprintf(w.ResponseWriter, "data: %s\n\n", bytes.TrimSpace(p))
+	return len(p), err
+}
+
+func (w *heldStreamWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *heldStreamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// zeroProvider reports as many of its endpoints as it has replicas
+type zeroProvider struct {
+	stubProvider
+	mux      sync.Mutex
+	replicas int
+	scalings []int
+	scaleErr error
+}
+
+func (z *zeroProvider) GetEndpoints() ([]provider.ServerEndpoint, error) {
+	z.mux.Lock()
+	defer z.mux.Unlock()
+	return z.endpoints[:min(z.replicas, len(z.endpoints))], nil
+}
+
+func (z *zeroProvider) AutoScaling(replica int) error {
+	z.mux.Lock()
+	defer z.mux.Unlock()
+	z.scalings = append(z.scalings, replica)
+	if z.scaleErr != nil {
+		return z.scaleErr
+	}
+	z.replicas = replica
+	return nil
+}
+
+func (z *zeroProvider) scaled() []int {
+	z.mux.Lock()
+	defer z.mux.Unlock()
+	return append([]int(nil), z.scalings...)
+}
+
+func newColdStartServer(t *testing.T, llmProvider *zeroProvider, config AutoscalerConfig) (*Server, *httptest.Server) {
+	poll, check, keepAlive := coldStartPoll, coldStartCheck, coldStartKeepAlive
+	coldStartPoll, coldStartCheck, coldStartKeepAlive = 20*time.Millisecond, 10*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() { coldStartPoll, coldStartCheck, coldStartKeepAlive = poll, check, keepAlive })
+
+	s := NewProxyServer(llmProvider)
+	if err := s.SetAutoscaling("llama", config); err != nil {
+		t.Fatal(err)
+	}
+	s.ReloadBackend()
+	t.Cleanup(s.pools[0].serverPool.Destroy)
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func TestAutoscaler_ScaleToZero(t *testing.T) {
+	llmProvider := &zeroProvider{stubProvider: stubProvider{model: "llama",
+		endpoints: []provider.ServerEndpoint{newBackend(t, "llama")}}, replicas: 1}
+	s, server := newColdStartServer(t, llmProvider, AutoscalerConfig{MinReplicas: 1, MaxReplicas: 2,
+		ScaleToZeroAfter: time.Hour, ColdStartTimeout: 5 * time.Second})
+	autoscaler := s.pools[0].autoscaler
+	now := time.Now()
+	autoscaler.now = func() time.Time { return now }
+
+	if replicas := autoscaler.Evaluate(); replicas != 1 {
+		t.Fatalf("%d replicas before the idle period, want 1", replicas)
+	}
+	now = now.Add(time.Hour)
+	if replicas := autoscaler.Evaluate(); replicas != 0 {
+		t.Fatalf("%d replicas after the idle period, want 0", replicas)
+	}
+	if replicas := autoscaler.Evaluate(); replicas != 0 {
+		t.Fatalf("%d replicas while asleep, want 0", replicas)
+	}
+	if backends := s.pools[0].serverPool.Backends(); len(backends) != 0 {
+		t.Fatalf("%d backends at zero replicas", len(backends))
+	}
+
+	// the provider reports no endpoints at zero replicas, the request waits for the wake up
+	response, err := http.Post(server.URL+"/v1/completions", "application/json", strings.NewReader(`{"model": "llama"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK || string(body) != "llama" {
+		t.Fatalf("held request: status %d, body %s", response.StatusCode, body)
+	}
+	if scaled := llmProvider.scaled(); len(scaled) != 2 || scaled[0] != 0 || scaled[1] != 1 {
+		t.Errorf("provider scaled to %v, want [0 1]", scaled)
+	}
+}
+
+func TestServer_ColdStartTimeout(t *testing.T) {
+	// the instances never come up
+	llmProvider := &zeroProvider{stubProvider: stubProvider{model: "llama"}}
+	s, server := newColdStartServer(t, llmProvider, AutoscalerConfig{MaxReplicas: 1,
+		ScaleToZeroAfter: time.Hour, ColdStartTimeout: 200 * time.Millisecond})
+	var accessLog syncBuffer
+	s.SetAccessLog(&accessLog)
+
+	response, err := http.Post(server.URL+"/v1/completions", "application/json", strings.NewReader(`{"model": "llama"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errorResponse ErrorResponse
+	_ = json.NewDecoder(response.Body).Decode(&errorResponse)
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable || response.Header.Get("Retry-After") == "" ||
+		errorResponse.Error.Code != "cold_start_timeout" {
+		t.Errorf("status %d, Retry-After %q, error %+v", response.StatusCode, response.Header.Get("Retry-After"), errorResponse.Error)
+	}
+
+	// a held stream is kept alive and ends with an error event
+	response, err = http.Post(server.URL+"/v1/completions", "application/json", strings.NewReader(`{"model": "llama", "stream": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), ": waiting for a backend to start\n\n") ||
+		!strings.Contains(string(body), `data: {"error":`) || !strings.Contains(string(body), "cold_start_timeout") {
+		t.Errorf("held stream: status %d, body %q", response.StatusCode, body)
+	}
+	// the stream went out with a 200, the access log tells how it ended
+	lines := accessLog.lines(t, 2)
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["status"] != 200.0 || entry["error"] != "503 Service Unavailable: The model is starting, please retry later" {
+		t.Errorf("access log of the held stream: %v", entry)
+	}
+	if scaled := llmProvider.scaled(); len(scaled) == 0 || scaled[0] != 1 {
+		t.Errorf("provider scaled to %v, want a wake up to 1", scaled)
+	}
+}
+
+func TestServer_ColdStartBudgetExceeded(t *testing.T) {
+	llmProvider := &zeroProvider{stubProvider: stubProvider{model: "llama"},
+		scaleErr: fmt.Errorf("%w: over the cap", provider.ErrBudgetExceeded)}
+	_, server := newColdStartServer(t, llmProvider, AutoscalerConfig{MaxReplicas: 1,
+		ScaleToZeroAfter: time.Hour, ColdStartTimeout: time.Minute})
+
+	// the request fails once the budget refused the wake up, the next one within the backoff right away
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		response, err := http.Post(server.URL+"/v1/completions", "application/json", strings.NewReader(`{"model": "llama"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var errorResponse ErrorResponse
+		_ = json.NewDecoder(response.Body).Decode(&errorResponse)
+		_ = response.Body.Close()
+		if response.StatusCode != http.StatusServiceUnavailable || response.Header.Get("Retry-After") == "" ||
+			errorResponse.Error.Code != "budget_exceeded" || time.Since(start) > time.Second {
+			t.Errorf("request %d: status %d, Retry-After %q, error %+v after %s", i, response.StatusCode,
+				response.Header.Get("Retry-After"), errorResponse.Error, time.Since(start))
+		}
+	}
+	if scaled := llmProvider.scaled(); len(scaled) != 1 {
+		t.Errorf("provider scaled to %v, want a single wake up within the backoff", scaled)
+	}
+}
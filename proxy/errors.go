@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorResponse is the OpenAI API error body
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
+
+// writeError replies with an OpenAI style error
+func writeError(w http.ResponseWriter, statusCode int, message, errType, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{
+		Error: ErrorDetail{
+			Message: message,
+			Type:    errType,
+			Code:    code,
+		},
+	})
+}
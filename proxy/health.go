@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 10 * time.Second
+)
+
+// SetHealthCheck sets how often the backends are health checked and how long a check may take. With
+// completion set, a check also runs a one token completion on the backend.
+func (s *ServerPool) SetHealthCheck(interval, timeout time.Duration, completion bool) {
+	s.mux.Lock()
+	s.healthInterval = interval
+	s.healthTimeout = timeout
+	s.healthCompletion = completion
+	s.mux.Unlock()
+}
+
+func (s *ServerPool) healthSettings() (interval, timeout time.Duration, completion bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	interval, timeout = s.healthInterval, s.healthTimeout
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	return interval, timeout, s.healthCompletion
+}
+
+// HealthCheck checks all backends of the pool and updates their status
+func (s *ServerPool) HealthCheck() {
+	s.checkBackends(s.Backends())
+}
+
+// checkBackends health checks backends of the pool concurrently
+func (s *ServerPool) checkBackends(backends []*Backend) {
+	if len(backends) == 0 {
+		return
+	}
+	_, timeout, completion := s.healthSettings()
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			info, err := checkBackend(ctx, b, completion)
+			wasAlive := b.IsAlive()
+			b.setHealth(err, info)
+			if err != nil {
+				log.Printf("%s [down] %v\n", b.URL, err)
+			} else if !wasAlive {
+				log.Printf("%s [up]\n", b.URL)
+			}
+		}(b)
+	}
+	wg.Wait()
+	s.Dispatch()
+}
+
+// checkBackend verifies the backend serves its model, and answers a completion when completion is set
+func checkBackend(ctx context.Context, b *Backend, completion bool) (*provider.LLMModelInfoResponse, error) {
+	var info provider.LLMModelInfoResponse
+	if err := healthRequest(ctx, http.MethodGet, b.URL.String()+b.HealthCheckURL, nil, &info); err != nil {
+		return nil, err
+	}
+	if info.ModelName == "" {
+		return nil, fmt.Errorf("model info without a model name")
+	}
+	if model := b.expectedModel(); model != "" && info.ModelName != model {
+		return &info, fmt.Errorf("serves model %s, want %s", info.ModelName, model)
+	}
+	if !completion {
+		return &info, nil
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"model": info.ModelName, "prompt": "Hello", "max_tokens": 1})
+	var response struct {
+		Choices []json.RawMessage `json:"choices"`
+	}
+	if err := healthRequest(ctx, http.MethodPost, b.URL.String()+"/v1/completions", body, &response); err != nil {
+		return &info, fmt.Errorf("completion: %w", err)
+	}
+	if len(response.Choices) == 0 {
+		return &info, fmt.Errorf("completion without choices")
+	}
+	return &info, nil
+}
+
+// healthRequest sends a health check request and decodes the JSON response into v
+func healthRequest(ctx context.Context, method, url string, body []byte, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(response.Body, 256))
+		return fmt.Errorf("status %d: %s", response.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// healthCheck health checks the backends of serverPool at its interval until the pool is destroyed
+func healthCheck(serverPool *ServerPool) {
+	interval, _, _ := serverPool.healthSettings()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		if serverPool.IsClose() {
+			return
+		}
+		serverPool.HealthCheck()
+	}
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHealthBackend serves model info for modelName and answers completions with status
+func newHealthBackend(t *testing.T, modelName string, infoStatus, completionStatus int, delay time.Duration) *Backend {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		time.Sleep(delay)
+		switch r.URL.Path {
+		case "/v1/internal/model/info":
+			w.WriteHeader(infoStatus)
+			_, _ = fmt.Fprintf(w, `{"model_name": %q}`, modelName)
+		case "/v1/completions":
+			w.WriteHeader(completionStatus)
+			_, _ = fmt.Fprint(w, `{"choices": [{"text": "!"}]}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	return &Backend{URL: u, Model: "llama", HealthCheckURL: "/v1/internal/model/info"}
+}
+
+func TestServerPool_HealthCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		backend    *Backend
+		completion bool
+		err        string
+	}{
+		{"healthy", newHealthBackend(t, "llama", 200, 200, 0), true, ""},
+		{"wrong model", newHealthBackend(t, "mixtral", 200, 200, 0), false, "serves model mixtral, want llama"},
+		{"server error", newHealthBackend(t, "llama", 500, 200, 0), false, "status 500"},
+		{"no completion check", newHealthBackend(t, "llama", 200, 500, 0), false, ""},
+		{"completion fails", newHealthBackend(t, "llama", 200, 500, 0), true, "completion: status 500"},
+		{"timeout", newHealthBackend(t, "llama", 200, 200, time.Second), false, "deadline exceeded"},
+	}
+	for _, tt := range tests {
+		pool := newTestPool(10, time.Second)
+		pool.SetHealthCheck(time.Minute, 300*time.Millisecond, tt.completion)
+		pool.AddBackend(tt.backend)
+		pool.HealthCheck()
+		_, err := tt.backend.LastHealthCheck()
+		switch {
+		case tt.err == "" && (err != nil || !tt.backend.IsAlive()):
+			t.Errorf("%s: health check failed: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err) || tt.backend.IsAlive()):
+			t.Errorf("%s: health check error %v, want %s", tt.name, err, tt.err)
+		}
+	}
+
+	// the checks of a pool run concurrently
+	pool := newTestPool(10, time.Second)
+	pool.SetHealthCheck(time.Minute, time.Second, false)
+	for i := 0; i < 5; i++ {
+		pool.AddBackend(newHealthBackend(t, "llama", 200, 200, 200*time.Millisecond))
+	}
+	start := time.Now()
+	pool.HealthCheck()
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("health check of 5 backends took %s", elapsed)
+	}
+}
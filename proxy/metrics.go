@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const noBackend = "none"
+
+// Metrics holds the prometheus metrics of the gateway
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	duration        *prometheus.HistogramVec
+	firstToken      *prometheus.HistogramVec
+	retries         *prometheus.CounterVec
+	attempts        *prometheus.CounterVec
+	endpoints       *prometheus.GaugeVec
+	providerErrors  *prometheus.CounterVec
+	desiredReplicas *prometheus.GaugeVec
+	budgetRefusals  *prometheus.CounterVec
+}
+
+func newMetrics(s *Server) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "llm_gateway_requests_total",
+			Help: "Requests handled by the gateway by model, backend and status code.",
+		}, []string{"model", "backend", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "llm_gateway_request_duration_seconds",
+			Help:    "Time from receiving a request to the end of its response.",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"model", "backend"}),
+		firstToken: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "llm_gateway_time_to_first_token_seconds",
+			Help:    "Time from receiving a streamed request to sending its first chunk.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60},
+		}, []string{"model", "backend"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "llm_gateway_backend_retries_total",
+			Help: "Requests retried on the same backend after a proxy error.",
+		}, []string{"model", "backend"}),
+		attempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "llm_gateway_backend_attempts_total",
+			Help: "Requests moved to another backend after the retries on a backend failed.",
+		}, []string{"model", "backend"}),
+		endpoints: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "llm_gateway_provider_endpoints",
+			Help: "Endpoints reported by the provider on the last backend reload.",
+		}, []string{"model"}),
+		providerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "llm_gateway_provider_errors_total",
+			Help: "Failed provider api calls by operation.",
+		}, []string{"model", "operation"}),
+		desiredReplicas: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "llm_gateway_autoscaler_desired_replicas",
+			Help: "Replicas the autoscaler computed for the load at its last evaluation.",
+		}, []string{"model"}),
+		budgetRefusals: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "llm_gateway_budget_refusals_total",
+			Help: "Scale ups refused by the provider for breaking the spend budget.",
+		}, []string{"model"}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.duration, m.firstToken, m.retries, m.attempts, m.endpoints, m.providerErrors, m.desiredReplicas,
+		m.budgetRefusals,
+		&poolCollector{server: s},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// scalingError counts a failed AutoScaling call of the provider of model
+func (m *Metrics) scalingError(model string, err error) {
+	m.providerError(model, "autoscaling", err)
+}
+
+// providerError counts a failed provider operation, and the budget refusals among them
+func (m *Metrics) providerError(model, operation string, err error) {
+	m.providerErrors.WithLabelValues(model, operation).Inc()
+	if errors.Is(err, provider.ErrBudgetExceeded) {
+		m.budgetRefusals.WithLabelValues(model).Inc()
+	}
+}
+
+// Handler serves the metrics in the prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeRequest records a finished request
+func (m *Metrics) observeRequest(model, backend string, w *statusWriter, start time.Time) {
+	if model == "" {
+		model = noBackend
+	}
+	if backend == "" {
+		backend = noBackend
+	}
+	m.requests.WithLabelValues(model, backend, strconv.Itoa(w.status)).Inc()
+	m.duration.WithLabelValues(model, backend).Observe(time.Since(start).Seconds())
+	if isEventStreamHeader(w.Header()) && !w.firstWrite.IsZero() {
+		m.firstToken.WithLabelValues(model, backend).Observe(w.firstWrite.Sub(start).Seconds())
+	}
+}
+
+var (
+	backendUpDesc = prometheus.NewDesc("llm_gateway_backend_up",
+		"Whether the backend is alive (1) or down (0).", []string{"model", "backend"}, nil)
+	backendInFlightDesc = prometheus.NewDesc("llm_gateway_backend_in_flight_requests",
+		"Requests being served by the backend.", []string{"model", "backend"}, nil)
+	backendCircuitDesc = prometheus.NewDesc("llm_gateway_backend_circuit_state",
+		"State of the backend circuit breaker: 0 closed, 1 open, 2 half-open.", []string{"model", "backend"}, nil)
+	queueLengthDesc = prometheus.NewDesc("llm_gateway_queue_length",
+		"Requests waiting at the gateway for a free backend.", []string{"model"}, nil)
+)
+
+// poolCollector reports the state of the backends in the pools at scrape time
+type poolCollector struct {
+	server *Server
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendUpDesc
+	ch <- backendInFlightDesc
+	ch <- backendCircuitDesc
+	ch <- queueLengthDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, pool := range c.server.pools {
+		serverPool := pool.serverPool
+		for _, b := range serverPool.Backends() {
+			up := 0.0
+			if b.IsAlive() {
+				up = 1
+			}
+			ch <- prometheus.MustNewConstMetric(backendUpDesc, prometheus.GaugeValue, up, pool.Name, b.URL.Host)
+			ch <- prometheus.MustNewConstMetric(backendInFlightDesc, prometheus.GaugeValue, float64(b.InFlight()),
+				pool.Name, b.URL.Host)
+			ch <- prometheus.MustNewConstMetric(backendCircuitDesc, prometheus.GaugeValue, float64(b.CircuitState()),
+				pool.Name, b.URL.Host)
+		}
+		ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(serverPool.QueueLength()),
+			pool.Name)
+	}
+}
+
+// statusWriter records the status code, size and first write of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status     int
+	bytes      int64
+	firstWrite time.Time
+}
+
+func newStatusWriter(w http.ResponseWriter) *statusWriter {
+	return &statusWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.firstWrite.IsZero() && len(p) > 0 {
+		w.firstWrite = time.Now()
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijack not supported")
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// reportingProvider is a stub reporting errors of its own operations
+type reportingProvider struct {
+	stubProvider
+	report func(operation string, err error)
+}
+
+func (r *reportingProvider) SetErrorReporter(report func(operation string, err error)) {
+	r.report = report
+}
+
+func TestServer_Metrics(t *testing.T) {
+	endpoint := newBackend(t, "llama")
+	llmProvider := &reportingProvider{stubProvider: stubProvider{model: "llama", endpoints: []provider.ServerEndpoint{endpoint}}}
+	_, server := newTestServer(t, llmProvider)
+	llmProvider.report("destroy", errors.New("api down"))
+	llmProvider.report("backfill", fmt.Errorf("%w: over the cap", provider.ErrBudgetExceeded))
+
+	for _, body := range []string{`{"model": "llama"}`, `{"model": "llama"}`, `{"model": "gpt-4"}`} {
+		response, err := http.Post(server.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+	}
+
+	response, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(response.Body)
+	metrics := string(data)
+
+	host := fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
+	for _, want := range []string{
+		fmt.Sprintf(`llm_gateway_requests_total{backend="%s",code="200",model="llama"} 2`, host),
+		`llm_gateway_requests_total{backend="none",code="404",model="none"} 1`,
+		fmt.Sprintf(`llm_gateway_request_duration_seconds_count{backend="%s",model="llama"} 2`, host),
+		fmt.Sprintf(`llm_gateway_backend_up{backend="%s",model="llama"} 1`, host),
+		fmt.Sprintf(`llm_gateway_backend_in_flight_requests{backend="%s",model="llama"} 0`, host),
+		`llm_gateway_queue_length{model="llama"} 0`,
+		`llm_gateway_provider_endpoints{model="llama"} 1`,
+		`llm_gateway_provider_errors_total{model="llama",operation="destroy"} 1`,
+		`llm_gateway_provider_errors_total{model="llama",operation="backfill"} 1`,
+		`llm_gateway_budget_refusals_total{model="llama"} 1`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Model is an entry of the OpenAI /v1/models response
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+	// Root is the pool model an alias belongs to
+	Root string `json:"root,omitempty"`
+	// Replicas is the number of alive backends serving the model
+	Replicas int `json:"replicas"`
+	// Loras are the loras loaded on the alive backends of a pool, they are not routed by name
+	Loras []string `json:"loras,omitempty"`
+	// BackendModels are model names the alive backends of a pool report other than the pool name
+	BackendModels []string `json:"backend_models,omitempty"`
+}
+
+type ModelList struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+// availableModels lists the models of every pool key may use with their aliases and the number of alive
+// backends serving them. The model names and loras the backends reported on the last health check can't be
+// requested by name, they are metadata of the pool entry.
+func (s *Server) availableModels(key *APIKey) []Model {
+	models := []Model{}
+	for _, pool := range s.pools {
+		replicas := 0
+		loras := make(map[string]bool)
+		backendModels := make(map[string]bool)
+		for _, b := range pool.serverPool.Backends() {
+			if !b.serving() {
+				continue
+			}
+			replicas++
+			info := b.GetModelInfo()
+			if info == nil {
+				continue
+			}
+			if info.ModelName != pool.Name {
+				backendModels[info.ModelName] = true
+			}
+			for _, lora := range info.LoraNames {
+				loras[fmt.Sprint(lora)] = true
+			}
+		}
+
+		newModel := func(id, root string, replicas int) Model {
+			return Model{
+				ID:       id,
+				Object:   "model",
+				Created:  pool.created.Unix(),
+				OwnedBy:  "llm-api-gateway",
+				Root:     root,
+				Replicas: replicas,
+			}
+		}
+		if key == nil || key.AllowsModel(pool.Name) {
+			model := newModel(pool.Name, "", replicas)
+			model.Loras = sortedKeys(loras)
+			model.BackendModels = sortedKeys(backendModels)
+			models = append(models, model)
+		}
+		var aliases []string
+		for alias, p := range s.models {
+			if p == pool && alias != pool.Name && (key == nil || key.AllowsModel(alias, pool.Name)) {
+				aliases = append(aliases, alias)
+			}
+		}
+		sort.Strings(aliases)
+		for _, alias := range aliases {
+			models = append(models, newModel(alias, pool.Name, replicas))
+		}
+	}
+	return models
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// listModels answers GET /v1/models and GET /v1/models/{model}
+func (s *Server) listModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed", r.Method),
+			"invalid_request_error", "method_not_allowed")
+		return
+	}
+	models := s.availableModels(GetAPIKeyFromContext(r))
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/models"), "/")
+	if id == "" {
+		writeJSON(w, ModelList{Object: "list", Data: models})
+		return
+	}
+	for _, model := range models {
+		if model.ID == id {
+			writeJSON(w, model)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("The model `%s` does not exist", id),
+		"invalid_request_error", "model_not_found")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -1,9 +1,8 @@
 package proxy
 
 import (
-	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -15,15 +14,36 @@ import (
 const (
 	Attempts int = iota
 	Retry
+	APIKeyContext
+	usageRecorderContext
+	requestLogContext
 )
 
 // Backend holds the data about a server
 type Backend struct {
+	ID             string
 	URL            *url.URL
 	Alive          bool
+	GPUName        string
+	CPUName        string
+	Origin         string
+	Weight         int
+	MaxConcurrency int // concurrent requests the backend takes, 0 means unlimited
+	PricePerHour   float64
 	mux            sync.RWMutex
 	ReverseProxy   *httputil.ReverseProxy
 	HealthCheckURL string
+	Model          string // model the backend must serve, checked by the health checks when set
+	ModelInfo      *provider.LLMModelInfoResponse
+	breaker        *CircuitBreaker // nil when circuit breaking is off
+
+	draining  bool      // drained by hand, takes no new requests, in-flight ones finish
+	retired   bool      // no longer reported by the provider, dropped once drained
+	checkedAt time.Time // last health check
+	healthErr error     // why the last health check failed
+	inFlight  int64
+	// currentWeight is the smooth weighted round-robin state, guarded by ServerPool.mux
+	currentWeight int
 }
 
 // SetAlive for this backend
@@ -41,69 +61,227 @@ func (b *Backend) IsAlive() (alive bool) {
 	return
 }
 
+// SetDraining stops sending new requests to the backend, or resumes it
+func (b *Backend) SetDraining(draining bool) {
+	b.mux.Lock()
+	b.draining = draining
+	b.mux.Unlock()
+}
+
+// IsDraining returns true when the backend takes no new requests, drained by hand or retired
+func (b *Backend) IsDraining() (draining bool) {
+	b.mux.RLock()
+	draining = b.draining || b.retired
+	b.mux.RUnlock()
+	return
+}
+
+// IsRetired returns true when the provider no longer reports the backend, it is dropped from the pool
+// once its in-flight requests are done
+func (b *Backend) IsRetired() (retired bool) {
+	b.mux.RLock()
+	retired = b.retired
+	b.mux.RUnlock()
+	return
+}
+
+// setRetired drains a backend removed by the provider, or puts it back into rotation when it returns
+// unless it was drained by hand
+func (b *Backend) setRetired(retired bool) {
+	b.mux.Lock()
+	b.retired = retired
+	b.mux.Unlock()
+}
+
+// update copies the settings of the endpoint reported for the backend by the last reload, the
+// pool lock must be held
+func (b *Backend) update(from *Backend) {
+	b.mux.Lock()
+	b.ID = from.ID
+	b.GPUName = from.GPUName
+	b.CPUName = from.CPUName
+	b.Origin = from.Origin
+	b.Weight = from.Weight
+	b.MaxConcurrency = from.MaxConcurrency
+	b.PricePerHour = from.PricePerHour
+	b.Model = from.Model
+	b.mux.Unlock()
+}
+
+// serving returns true when the backend takes new requests
+func (b *Backend) serving() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.Alive && !b.draining && !b.retired
+}
+
+// setHealth stores the result of a health check, err is nil when it passed
+func (b *Backend) setHealth(err error, info *provider.LLMModelInfoResponse) {
+	b.mux.Lock()
+	b.Alive = err == nil
+	b.healthErr = err
+	b.ModelInfo = info
+	b.checkedAt = time.Now()
+	b.mux.Unlock()
+}
+
+// LastHealthCheck returns when the backend was last health checked, zero if never, and why the
+// check failed
+func (b *Backend) LastHealthCheck() (checkedAt time.Time, err error) {
+	b.mux.RLock()
+	checkedAt, err = b.checkedAt, b.healthErr
+	b.mux.RUnlock()
+	return
+}
+
+// expectedModel returns the model the backend must serve, empty if any
+func (b *Backend) expectedModel() string {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.Model
+}
+
+// IncInFlight counts a request sent to this backend
+func (b *Backend) IncInFlight() {
+	atomic.AddInt64(&b.inFlight, 1)
+}
+
+// DecInFlight counts a request to this backend as finished
+func (b *Backend) DecInFlight() {
+	atomic.AddInt64(&b.inFlight, -1)
+}
+
+// InFlight returns the number of requests being served by this backend
+func (b *Backend) InFlight() int64 {
+	return atomic.LoadInt64(&b.inFlight)
+}
+
+func (b *Backend) weight() int {
+	if b.Weight <= 0 {
+		return 1
+	}
+	return b.Weight
+}
+
+// SetModelInfo stores the model info reported by the last health check
+func (b *Backend) SetModelInfo(info *provider.LLMModelInfoResponse) {
+	b.mux.Lock()
+	b.ModelInfo = info
+	b.mux.Unlock()
+}
+
+// GetModelInfo returns the model info reported by the last health check, nil if unknown
+func (b *Backend) GetModelInfo() (info *provider.LLMModelInfoResponse) {
+	b.mux.RLock()
+	info = b.ModelInfo
+	b.mux.RUnlock()
+	return
+}
+
 // ServerPool holds information about reachable backends
 type ServerPool struct {
 	backends []*Backend
-	current  uint64
+	balancer Balancer
+	mux      sync.Mutex
 	close    bool
+
+	queue        []*waiter
+	queueSize    int
+	queueTimeout time.Duration
+	maxWait      time.Duration // longest wait for a backend since TakeMaxWait
+	lastActive   time.Time     // last time a request took or handed back a backend
+
+	healthInterval   time.Duration
+	healthTimeout    time.Duration
+	healthCompletion bool
 }
 
 func (s *ServerPool) Destroy() {
+	s.mux.Lock()
 	s.close = true
+	s.mux.Unlock()
 }
 
 func (s *ServerPool) IsClose() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	return s.close
 }
 
 // AddBackend to the server pool
 func (s *ServerPool) AddBackend(backend *Backend) {
+	s.mux.Lock()
 	s.backends = append(s.backends, backend)
+	s.mux.Unlock()
+	s.Dispatch()
+}
+
+// Sync makes the pool serve backends, matched to the current ones by host. Current backends keep
+// their state and take the settings of the matching new one, unmatched ones are retired: they drain
+// and leave the pool once their in-flight requests are done. Sync returns the backends added.
+func (s *ServerPool) Sync(backends []*Backend) (added []*Backend) {
+	s.mux.Lock()
+	current := make(map[string]*Backend, len(s.backends))
+	for _, b := range s.backends {
+		current[b.URL.Host] = b
+	}
+	next := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if existing, ok := current[b.URL.Host]; ok {
+			existing.update(b)
+			existing.setRetired(false)
+			next = append(next, existing)
+			delete(current, b.URL.Host)
+			continue
+		}
+		next = append(next, b)
+		added = append(added, b)
+	}
+	for _, b := range s.backends {
+		if _, ok := current[b.URL.Host]; !ok {
+			continue
+		}
+		if b.InFlight() > 0 {
+			b.setRetired(true)
+			next = append(next, b)
+			log.Printf("%s [draining]\n", b.URL)
+		} else {
+			log.Printf("%s [removed]\n", b.URL)
+		}
+	}
+	s.backends = next
+	s.mux.Unlock()
+	s.Dispatch()
+	return added
 }
 
-// NextIndex atomically increase the counter and return an index
-func (s *ServerPool) NextIndex() int {
-	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.backends)))
+// Backends returns a snapshot of the backends in the pool
+func (s *ServerPool) Backends() []*Backend {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	backends := make([]*Backend, len(s.backends))
+	copy(backends, s.backends)
+	return backends
 }
 
 // MarkBackendStatus changes a status of a backend
 func (s *ServerPool) MarkBackendStatus(backendUrl *url.URL, alive bool) {
-	for _, b := range s.backends {
+	for _, b := range s.Backends() {
 		if b.URL.String() == backendUrl.String() {
 			b.SetAlive(alive)
 			break
 		}
 	}
-}
-
-// GetNextPeer returns next active peer to take a connection
-func (s *ServerPool) GetNextPeer() *Backend {
-	// loop entire backends to find out an Alive backend
-	next := s.NextIndex()
-	l := len(s.backends) + next // start from next and move a full cycle
-	for i := next; i < l; i++ {
-		idx := i % len(s.backends)     // take an index by modding
-		if s.backends[idx].IsAlive() { // if we have an alive backend, use it and store if its not the original one
-			if i != next {
-				atomic.StoreUint64(&s.current, uint64(idx))
-			}
-			return s.backends[idx]
-		}
+	if alive {
+		s.Dispatch()
 	}
-	return nil
 }
 
-// HealthCheck pings the backends and update the status
-func (s *ServerPool) HealthCheck() {
-	for _, b := range s.backends {
-		status := "up"
-		alive := httpHealthCheck(fmt.Sprintf("%s%s", b.URL.String(), b.HealthCheckURL))
-		b.SetAlive(alive)
-		if !alive {
-			status = "down"
-		}
-		log.Printf("%s [%s]\n", b.URL, status)
-	}
+// SetBalancer changes how backends are picked, round-robin by default
+func (s *ServerPool) SetBalancer(balancer Balancer) {
+	s.mux.Lock()
+	s.balancer = balancer
+	s.mux.Unlock()
 }
 
 // GetAttemptsFromContext returns the attempts for request
@@ -121,51 +299,3 @@ func GetRetryFromContext(r *http.Request) int {
 	}
 	return 0
 }
-
-// isAlive checks whether a backend is Alive by establishing a TCP connection
-func isBackendAlive(u *url.URL) bool {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", u.Host, timeout)
-	if err != nil {
-		log.Println("Site unreachable, error: ", err)
-		return false
-	}
-	defer func() {
-		_ = conn.Close()
-	}()
-	return true
-}
-
-func httpHealthCheck(url string) bool {
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("accept", "application/json")
-	httpClient := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-	response, err := httpClient.Do(req)
-	if err != nil {
-		return false
-	}
-	if response != nil {
-		defer func() {
-			_ = response.Body.Close()
-		}()
-	}
-	return true
-}
-
-// healthCheck runs a routine for check status of the backends every 3 mins
-func healthCheck(serverPool *ServerPool) {
-	t := time.NewTicker(time.Minute * 3)
-	for {
-		select {
-		case <-t.C:
-			if serverPool.IsClose() {
-				return
-			}
-			log.Println("Starting health check...")
-			serverPool.HealthCheck()
-			log.Println("Health check completed")
-		}
-	}
-}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoBackend    = errors.New("no backend available")
+	ErrQueueFull    = errors.New("request queue is full")
+	ErrQueueTimeout = errors.New("timed out waiting in the request queue")
+)
+
+const (
+	defaultQueueSize    = 100
+	defaultQueueTimeout = 30 * time.Second
+	// defaultMaxConcurrency applies to backends with an unknown GPU
+	defaultMaxConcurrency = 4
+)
+
+// gpuConcurrency is the default number of concurrent requests per GPU type, matched against
+// ServerEndpoint.GPUName by the longest name it contains
+var gpuConcurrency = map[string]int{
+	"H100":     16,
+	"A100":     12,
+	"L40":      8,
+	"A6000":    8,
+	"RTX 4090": 4,
+	"RTX 3090": 4,
+	"A10":      4,
+	"T4":       2,
+}
+
+// concurrencyForGPU returns the max concurrency of gpuName from limits, fallback if it matches none
+func concurrencyForGPU(gpuName string, limits map[string]int, fallback int) int {
+	var names []string
+	for name := range limits {
+		if strings.Contains(strings.ToUpper(gpuName), strings.ToUpper(name)) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fallback
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+	return limits[names[0]]
+}
+
+type waiter struct {
+	backend chan *Backend
+	queued  time.Time
+}
+
+// SetQueue sets how many requests may wait for a free backend and for how long
+func (s *ServerPool) SetQueue(size int, timeout time.Duration) {
+	s.mux.Lock()
+	s.queueSize = size
+	s.queueTimeout = timeout
+	s.mux.Unlock()
+}
+
+// observeWait notes how long a request waited for a backend
+func (s *ServerPool) observeWait(wait time.Duration) {
+	s.mux.Lock()
+	if wait > s.maxWait {
+		s.maxWait = wait
+	}
+	s.mux.Unlock()
+}
+
+// TakeMaxWait returns the longest a request waited for a backend since the last call, requests still
+// waiting included, and starts over
+func (s *ServerPool) TakeMaxWait() time.Duration {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	wait := s.maxWait
+	if len(s.queue) > 0 && time.Since(s.queue[0].queued) > wait {
+		wait = time.Since(s.queue[0].queued)
+	}
+	s.maxWait = 0
+	return wait
+}
+
+// LastActive returns the last time a request took or handed back a backend, zero if none did
+func (s *ServerPool) LastActive() time.Time {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.lastActive
+}
+
+// Serving returns true when a backend takes requests
+func (s *ServerPool) Serving() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.hasServing()
+}
+
+// QueueLength returns the number of requests waiting for a free backend
+func (s *ServerPool) QueueLength() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.queue)
+}
+
+// Acquire returns a backend with a free concurrency slot, waiting in a FIFO queue while all alive
+// backends are busy. The backend must be handed back with Release.
+func (s *ServerPool) Acquire(ctx context.Context) (*Backend, error) {
+	s.mux.Lock()
+	s.lastActive = time.Now()
+	if len(s.queue) == 0 {
+		if b := s.nextAvailable(); b != nil {
+			b.IncInFlight()
+			s.mux.Unlock()
+			return b, nil
+		}
+	}
+	if !s.hasServing() {
+		s.mux.Unlock()
+		return nil, ErrNoBackend
+	}
+	if len(s.queue) >= s.queueSize {
+		s.mux.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{backend: make(chan *Backend, 1), queued: time.Now()}
+	s.queue = append(s.queue, w)
+	timeout := s.queueTimeout
+	s.mux.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case b := <-w.backend:
+		s.observeWait(time.Since(w.queued))
+		return b, nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mux.Lock()
+	for i, queued := range s.queue {
+		if queued == w {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	s.mux.Unlock()
+	s.observeWait(time.Since(w.queued))
+	// a backend may have been handed over while giving up, with the probe of its breaker
+	select {
+	case b := <-w.backend:
+		b.breakerCancel()
+		s.Release(b)
+	default:
+	}
+	return nil, err
+}
+
+// Release frees the concurrency slot taken by Acquire and passes it on to the next queued request
+func (s *ServerPool) Release(b *Backend) {
+	b.DecInFlight()
+	s.mux.Lock()
+	s.lastActive = time.Now()
+	s.mux.Unlock()
+	if b.IsRetired() {
+		s.removeDrained(b)
+	}
+	s.Dispatch()
+}
+
+// removeDrained drops a retired backend from the pool once its last request is done
+func (s *ServerPool) removeDrained(b *Backend) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	// checked under the lock, Sync may have brought the backend back and Acquire may have picked it
+	if !b.IsRetired() || b.InFlight() > 0 {
+		return
+	}
+	for i, backend := range s.backends {
+		if backend == b {
+			s.backends = append(s.backends[:i:i], s.backends[i+1:]...)
+			log.Printf("%s [removed]\n", b.URL)
+			return
+		}
+	}
+}
+
+// Dispatch hands free backends to queued requests, call it when backends become available
+func (s *ServerPool) Dispatch() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.dispatch()
+}
+
+// dispatch hands free backends to queued requests, the lock must be held
+func (s *ServerPool) dispatch() {
+	for len(s.queue) > 0 {
+		b := s.nextAvailable()
+		if b == nil {
+			return
+		}
+		b.IncInFlight()
+		w := s.queue[0]
+		s.queue = s.queue[1:]
+		w.backend <- b
+	}
+}
+
+// nextAvailable picks among the serving backends below their concurrency limit whose circuit lets
+// requests through, the lock must be held
+func (s *ServerPool) nextAvailable() *Backend {
+	var available []*Backend
+	for _, b := range s.backends {
+		if b.serving() && b.breakerReady() && (b.MaxConcurrency <= 0 || b.InFlight() < int64(b.MaxConcurrency)) {
+			available = append(available, b)
+		}
+	}
+	if s.balancer == nil {
+		s.balancer = new(RoundRobinBalancer)
+	}
+	b := s.balancer.Next(available)
+	if b != nil {
+		b.breakerBegin()
+	}
+	return b
+}
+
+func (s *ServerPool) hasServing() bool {
+	for _, b := range s.backends {
+		if b.serving() {
+			return true
+		}
+	}
+	return false
+}
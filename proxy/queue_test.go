@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestPool(queueSize int, queueTimeout time.Duration, maxConcurrency ...int) *ServerPool {
+	pool := new(ServerPool)
+	pool.SetQueue(queueSize, queueTimeout)
+	for i, b := range newTestBackends(make([]int, len(maxConcurrency))...) {
+		b.MaxConcurrency = maxConcurrency[i]
+		pool.AddBackend(b)
+	}
+	return pool
+}
+
+func TestServerPool_AcquireQueue(t *testing.T) {
+	pool := newTestPool(2, time.Second, 1)
+	ctx := context.Background()
+
+	first, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two requests queue up in order, the third is rejected
+	acquired := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		go func(i int) {
+			b, err := pool.Acquire(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			acquired <- i
+			time.Sleep(10 * time.Millisecond)
+			pool.Release(b)
+		}(i)
+		for pool.QueueLength() < i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if _, err := pool.Acquire(ctx); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("got %v, want ErrQueueFull", err)
+	}
+
+	pool.Release(first)
+	if a, b := <-acquired, <-acquired; a != 1 || b != 2 {
+		t.Errorf("queued requests served as %d, %d", a, b)
+	}
+}
+
+func TestServerPool_AcquireTimeout(t *testing.T) {
+	pool := newTestPool(1, 20*time.Millisecond, 1, 0)
+	pool.backends[1].SetAlive(false)
+	ctx := context.Background()
+
+	b, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Acquire(ctx); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("got %v, want ErrQueueTimeout", err)
+	}
+	if pool.QueueLength() != 0 {
+		t.Error("timed out request left in the queue")
+	}
+
+	// a backend coming back takes the queued request
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		pool.MarkBackendStatus(pool.backends[1].URL, true)
+	}()
+	unlimited, err := pool.Acquire(ctx)
+	if err != nil || unlimited != pool.backends[1] {
+		t.Errorf("got %v %v, want the revived backend", unlimited, err)
+	}
+	pool.Release(b)
+	pool.Release(unlimited)
+	if b.InFlight() != 0 || unlimited.InFlight() != 0 {
+		t.Error("in-flight count not released")
+	}
+
+	for _, backend := range pool.backends {
+		backend.SetAlive(false)
+	}
+	if _, err := pool.Acquire(ctx); !errors.Is(err, ErrNoBackend) {
+		t.Errorf("got %v, want ErrNoBackend", err)
+	}
+}
+
+func TestConcurrencyForGPU(t *testing.T) {
+	tests := map[string]int{
+		"A100 SXM4": 12,
+		"A10":       4,
+		"RTX 4090":  4,
+		"Tesla T4":  2,
+		"":          1,
+		"MI300X":    1,
+	}
+	for gpuName, want := range tests {
+		if got := concurrencyForGPU(gpuName, gpuConcurrency, 1); got != want {
+			t.Errorf("%q: got %d, want %d", gpuName, got, want)
+		}
+	}
+}
+
+func TestServerPool_AcquireGiveUpProbe(t *testing.T) {
+	pool := newTestPool(1, time.Minute, 1)
+	b := pool.backends[0]
+	now := time.Unix(0, 0)
+	b.breaker = NewCircuitBreaker(1, time.Second, nil)
+	b.breaker.now = func() time.Time { return now }
+
+	busy, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.breakerResult(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := pool.Acquire(ctx)
+		done <- err
+	}()
+	for pool.QueueLength() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// the breaker is open, the freed slot stays free
+	pool.Release(busy)
+
+	// the probe is handed to the request while it gives up
+	pool.mux.Lock()
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	now = now.Add(time.Second)
+	pool.dispatch()
+	pool.mux.Unlock()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if b.InFlight() != 0 || !b.breakerReady() {
+		t.Errorf("in flight %d, breaker ready %v, want the probe released", b.InFlight(), b.breakerReady())
+	}
+}
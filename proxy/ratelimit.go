@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultCompletionTokens is the completion size assumed for requests without max_tokens
+const defaultCompletionTokens = 256
+
+// bucket is a token bucket refilling its capacity once per minute
+type bucket struct {
+	tokens   float64
+	capacity float64
+	last     time.Time
+}
+
+func newBucket(perMinute int, now time.Time) *bucket {
+	return &bucket{tokens: float64(perMinute), capacity: float64(perMinute), last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Minutes()*b.capacity)
+	b.last = now
+}
+
+// wait returns how long until n tokens are available
+func (b *bucket) wait(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.capacity * float64(time.Minute))
+}
+
+// reset returns how long until the bucket is full again
+func (b *bucket) reset() time.Duration {
+	return b.wait(b.capacity)
+}
+
+// RateLimitStatus describes the limits of a key after a request, as sent in the x-ratelimit-* headers
+type RateLimitStatus struct {
+	LimitRequests     int
+	RemainingRequests int
+	ResetRequests     time.Duration
+	LimitTokens       int
+	RemainingTokens   int
+	ResetTokens       time.Duration
+	// RetryAfter is set when the request was rejected
+	RetryAfter time.Duration
+}
+
+func (s RateLimitStatus) setHeaders(h http.Header) {
+	if s.LimitRequests > 0 {
+		h.Set("x-ratelimit-limit-requests", strconv.Itoa(s.LimitRequests))
+		h.Set("x-ratelimit-remaining-requests", strconv.Itoa(s.RemainingRequests))
+		h.Set("x-ratelimit-reset-requests", formatReset(s.ResetRequests))
+	}
+	if s.LimitTokens > 0 {
+		h.Set("x-ratelimit-limit-tokens", strconv.Itoa(s.LimitTokens))
+		h.Set("x-ratelimit-remaining-tokens", strconv.Itoa(s.RemainingTokens))
+		h.Set("x-ratelimit-reset-tokens", formatReset(s.ResetTokens))
+	}
+}
+
+// formatReset formats like OpenAI, e.g. 1s, 6m0s or 120ms
+func formatReset(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+type keyBuckets struct {
+	requests *bucket
+	tokens   *bucket
+}
+
+// RateLimiter enforces the requests and tokens per minute of each API key
+type RateLimiter struct {
+	mux     sync.Mutex
+	buckets map[string]*keyBuckets
+	now     func() time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]*keyBuckets),
+		now:     time.Now,
+	}
+}
+
+// Allow takes one request and tokens from the limits of key, nothing is taken when the request is rejected
+func (l *RateLimiter) Allow(key *APIKey, tokens int) (RateLimitStatus, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	b := l.get(key)
+
+	var retryAfter time.Duration
+	if b.requests != nil {
+		retryAfter = b.requests.wait(1)
+	}
+	if b.tokens != nil {
+		// a request larger than the whole limit can only wait for a full bucket
+		retryAfter = maxDuration(retryAfter, b.tokens.wait(math.Min(float64(tokens), b.tokens.capacity)))
+		if float64(tokens) > b.tokens.capacity && b.tokens.tokens < b.tokens.capacity {
+			retryAfter = maxDuration(retryAfter, b.tokens.reset())
+		}
+	}
+	if retryAfter > 0 {
+		status := l.status(b)
+		status.RetryAfter = retryAfter
+		return status, false
+	}
+	if b.requests != nil {
+		b.requests.tokens--
+	}
+	if b.tokens != nil {
+		b.tokens.tokens -= float64(tokens)
+	}
+	return l.status(b), true
+}
+
+// Adjust corrects the tokens taken by Allow once the actual usage is known
+func (l *RateLimiter) Adjust(key *APIKey, estimated, actual int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	b := l.get(key)
+	if b.tokens != nil {
+		b.tokens.tokens = math.Min(b.tokens.capacity, b.tokens.tokens+float64(estimated-actual))
+	}
+}
+
+// get returns the refilled buckets of key, the lock must be held
+func (l *RateLimiter) get(key *APIKey) *keyBuckets {
+	now := l.now()
+	b, ok := l.buckets[key.Hash]
+	if !ok {
+		b = new(keyBuckets)
+		if key.RequestsPerMinute > 0 {
+			b.requests = newBucket(key.RequestsPerMinute, now)
+		}
+		if key.TokensPerMinute > 0 {
+			b.tokens = newBucket(key.TokensPerMinute, now)
+		}
+		l.buckets[key.Hash] = b
+	}
+	if b.requests != nil {
+		b.requests.refill(now)
+	}
+	if b.tokens != nil {
+		b.tokens.refill(now)
+	}
+	return b
+}
+
+func (l *RateLimiter) status(b *keyBuckets) RateLimitStatus {
+	var status RateLimitStatus
+	if b.requests != nil {
+		status.LimitRequests = int(b.requests.capacity)
+		status.RemainingRequests = int(math.Max(0, b.requests.tokens))
+		status.ResetRequests = b.requests.reset()
+	}
+	if b.tokens != nil {
+		status.LimitTokens = int(b.tokens.capacity)
+		status.RemainingTokens = int(math.Max(0, b.tokens.tokens))
+		status.ResetTokens = b.tokens.reset()
+	}
+	return status
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// estimateTokens guesses the prompt and completion tokens of a request before it runs,
+// about four bytes of the request body per prompt token plus max_tokens
+func estimateTokens(body []byte, request openAIRequest) int {
+	completion := request.MaxTokens
+	if completion <= 0 {
+		completion = defaultCompletionTokens
+	}
+	n := request.N
+	if n <= 0 {
+		n = 1
+	}
+	return (len(body)+3)/4 + completion*n
+}
+
+// checkRateLimit applies the limits of the request API key, it replies and returns false when exceeded
+func (s *Server) checkRateLimit(w http.ResponseWriter, key *APIKey, tokens int) bool {
+	status, ok := s.rateLimiter.Allow(key, tokens)
+	status.setHeaders(w.Header())
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(status.RetryAfter.Seconds()))))
+	message := fmt.Sprintf("Rate limit reached for %s, please try again in %s.", key.Owner, formatReset(status.RetryAfter))
+	writeError(w, http.StatusTooManyRequests, message, "requests", "rate_limit_exceeded")
+	return false
+}
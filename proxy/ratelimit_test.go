@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewRateLimiter()
+	limiter.now = func() time.Time { return now }
+	key := &APIKey{Hash: "a", Owner: "team-a", RequestsPerMinute: 2, TokensPerMinute: 1000}
+
+	if _, ok := limiter.Allow(key, 400); !ok {
+		t.Fatal("first request rejected")
+	}
+	status, ok := limiter.Allow(key, 400)
+	if !ok {
+		t.Fatal("second request rejected")
+	}
+	if status.RemainingRequests != 0 || status.RemainingTokens != 200 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	status, ok = limiter.Allow(key, 100)
+	if ok || status.RetryAfter != 30*time.Second {
+		t.Errorf("third request: allowed %v, retry after %s", ok, status.RetryAfter)
+	}
+
+	// the requests bucket refills first, tokens are still short
+	now = now.Add(30 * time.Second)
+	status, ok = limiter.Allow(key, 800)
+	if ok || status.RetryAfter != 6*time.Second {
+		t.Errorf("token limited request: allowed %v, retry after %s", ok, status.RetryAfter)
+	}
+
+	// the actual usage was lower than estimated
+	limiter.Adjust(key, 800, 200)
+	if _, ok := limiter.Allow(key, 800); !ok {
+		t.Error("request rejected after adjusting the usage")
+	}
+
+	recorder := httptest.NewRecorder()
+	status.setHeaders(recorder.Header())
+	for header, want := range map[string]string{
+		"x-ratelimit-limit-requests": "2",
+		"x-ratelimit-limit-tokens":   "1000",
+		"x-ratelimit-reset-tokens":   "18s",
+	} {
+		if got := recorder.Header().Get(header); got != want {
+			t.Errorf("%s: got %s, want %s", header, got, want)
+		}
+	}
+
+	unlimited := &APIKey{Hash: "b"}
+	for i := 0; i < 100; i++ {
+		if _, ok := limiter.Allow(unlimited, 100000); !ok {
+			t.Fatal("unlimited key rejected")
+		}
+	}
+}
@@ -3,17 +3,24 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/beyondblog/llm-api-gateway/provider"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"log"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -34,130 +41,386 @@ func (w *fakeCloseReadCloser) RealClose() error {
 
 type Server struct {
 	BackendList []string
+	pools       []*ModelPool
+	models      map[string]*ModelPool // model names and aliases
+	keys        *KeyStore
+	rateLimiter *RateLimiter
+	usage       *UsageStore
+	adminToken  string
+	metrics     *Metrics
+	accessLog   *slog.Logger
+
+	balancer              string
+	maxConcurrency        int
+	gpuConcurrency        map[string]int
+	queueSize             int
+	queueTimeout          time.Duration
+	streamIdleTimeout     time.Duration
+	breakerThreshold      int
+	breakerCooldown       time.Duration
+	responseHeaderTimeout time.Duration
+	transportOnce         sync.Once
+	transport             http.RoundTripper
+}
+
+// ModelPool holds the backends serving one model
+type ModelPool struct {
+	Name        string
 	serverPool  *ServerPool
 	llmProvider provider.LLMProvider
+	created     time.Time
+	autoscaler  *Autoscaler // nil when the replicas are managed by hand
 }
 
-func NewProxyServer(llmProvider provider.LLMProvider) *Server {
+// NewProxyServer creates a server with one model pool per provider, requests without a
+// model are routed to the first one
+func NewProxyServer(llmProviders ...provider.LLMProvider) *Server {
 	server := new(Server)
-	server.llmProvider = llmProvider
+	server.models = make(map[string]*ModelPool)
+	server.rateLimiter = NewRateLimiter()
+	server.gpuConcurrency = gpuConcurrency
+	server.queueSize = defaultQueueSize
+	server.queueTimeout = defaultQueueTimeout
+	server.streamIdleTimeout = time.Minute
+	server.breakerThreshold = defaultBreakerThreshold
+	server.breakerCooldown = defaultBreakerCooldown
+	server.responseHeaderTimeout = 10 * time.Minute
+	server.metrics = newMetrics(server)
+	server.SetAccessLog(os.Stdout)
+	for _, llmProvider := range llmProviders {
+		serverPool := new(ServerPool)
+		serverPool.SetQueue(server.queueSize, server.queueTimeout)
+		pool := &ModelPool{
+			Name:        llmProvider.GetModel(),
+			serverPool:  serverPool,
+			llmProvider: llmProvider,
+			created:     time.Now(),
+		}
+		if _, ok := server.models[pool.Name]; ok {
+			log.Printf("model %s is configured twice, requests go to the first pool\n", pool.Name)
+			continue
+		}
+		if reporter, ok := llmProvider.(provider.ErrorReporter); ok {
+			reporter.SetErrorReporter(func(operation string, err error) {
+				server.metrics.providerError(pool.Name, operation, err)
+			})
+		}
+		server.pools = append(server.pools, pool)
+		server.models[pool.Name] = pool
+	}
 	return server
 }
 
+// AddAlias routes requests for the alias model name, e.g. gpt-3.5-turbo, to the pool of model
+func (s *Server) AddAlias(alias, model string) error {
+	pool, ok := s.models[model]
+	if !ok {
+		return fmt.Errorf("alias %s: unknown model %s", alias, model)
+	}
+	if existing, ok := s.models[alias]; ok && existing != pool {
+		return fmt.Errorf("alias %s: already used by model %s", alias, existing.Name)
+	}
+	s.models[alias] = pool
+	return nil
+}
+
+// SetBalancer sets the balancer strategy of the pools, see NewBalancer
+func (s *Server) SetBalancer(name string) error {
+	if _, err := NewBalancer(name); err != nil {
+		return err
+	}
+	s.balancer = name
+	for _, pool := range s.pools {
+		// each pool keeps its own balancer state
+		balancer, _ := NewBalancer(name)
+		pool.serverPool.SetBalancer(balancer)
+	}
+	return nil
+}
+
+// SetKeyStore requires clients to authenticate with one of the keys, nil disables authentication
+func (s *Server) SetKeyStore(keys *KeyStore) {
+	s.keys = keys
+}
+
+// SetUsageStore records the token usage of every request in store, nil disables usage accounting
+func (s *Server) SetUsageStore(store *UsageStore) {
+	s.usage = store
+}
+
+// SetAdminToken enables the /admin api for requests bearing token
+func (s *Server) SetAdminToken(token string) {
+	s.adminToken = token
+}
+
+// SetConcurrencyLimits sets the concurrent requests per backend. A positive maxConcurrency
+// applies to all backends, zero derives it from the GPU name using byGPU on top of the built-in
+// table and a negative one disables the limit. ServerEndpoint.MaxConcurrency takes precedence.
+func (s *Server) SetConcurrencyLimits(maxConcurrency int, byGPU map[string]int) {
+	s.maxConcurrency = maxConcurrency
+	limits := make(map[string]int)
+	for name, limit := range gpuConcurrency {
+		limits[name] = limit
+	}
+	for name, limit := range byGPU {
+		limits[name] = limit
+	}
+	s.gpuConcurrency = limits
+}
+
+// SetQueue sets how many requests may wait at the gateway for a free backend and for how long
+func (s *Server) SetQueue(size int, timeout time.Duration) {
+	s.queueSize = size
+	s.queueTimeout = timeout
+	for _, pool := range s.pools {
+		pool.serverPool.SetQueue(size, timeout)
+	}
+}
+
+// backendConcurrency returns the concurrency limit of endpoint, 0 means unlimited
+func (s *Server) backendConcurrency(endpoint provider.ServerEndpoint) int {
+	switch {
+	case endpoint.MaxConcurrency > 0:
+		return endpoint.MaxConcurrency
+	case s.maxConcurrency > 0:
+		return s.maxConcurrency
+	case s.maxConcurrency < 0:
+		return 0
+	}
+	return concurrencyForGPU(endpoint.GPUName, s.gpuConcurrency, defaultMaxConcurrency)
+}
+
+// SetStreamIdleTimeout sets how long a streamed response may go without a chunk from the
+// backend before it is ended with an error event, zero disables it
+func (s *Server) SetStreamIdleTimeout(timeout time.Duration) {
+	s.streamIdleTimeout = timeout
+}
+
+// SetHealthCheck sets how often the backends are health checked and the timeout of a check, zero
+// keeps the defaults. A check verifies the backend serves its model, with completion set it also
+// runs a one token completion.
+func (s *Server) SetHealthCheck(interval, timeout time.Duration, completion bool) {
+	for _, pool := range s.pools {
+		pool.serverPool.SetHealthCheck(interval, timeout, completion)
+	}
+}
+
+// SetAutoscaling lets an autoscaler size the replicas of model to its load, see AutoscalerConfig
+func (s *Server) SetAutoscaling(model string, config AutoscalerConfig) error {
+	pool, ok := s.models[model]
+	if !ok {
+		return fmt.Errorf("autoscaling: unknown model %s", model)
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("autoscaling %s: %w", model, err)
+	}
+	pool.autoscaler = newAutoscaler(s, pool, config)
+	return nil
+}
+
+// SetCircuitBreaker takes a backend out of rotation for cooldown after threshold consecutive failed
+// requests, a threshold of zero turns circuit breaking off and backends are marked down after the retries
+func (s *Server) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	s.breakerThreshold = threshold
+	s.breakerCooldown = cooldown
+}
+
+// SetResponseHeaderTimeout sets how long to wait for the backend response headers. Non-streamed
+// completions only send headers once generation is done, so keep it above the longest generation.
+func (s *Server) SetResponseHeaderTimeout(timeout time.Duration) {
+	s.responseHeaderTimeout = timeout
+}
+
+// getTransport returns the transport shared by all backends, streams are bounded by the idle
+// timeout of each chunk rather than by a timeout on the whole request
+func (s *Server) getTransport() http.RoundTripper {
+	s.transportOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = s.responseHeaderTimeout
+		transport.MaxIdleConnsPerHost = 100
+		s.transport = &tracingTransport{base: transport}
+	})
+	return s.transport
+}
+
+// ReloadBackend reloads the endpoints of every model pool
 func (s *Server) ReloadBackend() {
+	for _, pool := range s.pools {
+		s.reloadPool(pool)
+	}
+}
 
-	serverPool := new(ServerPool)
-	serverEndpoint, err := s.llmProvider.GetEndpoints()
+// reloadPool syncs the backends of pool with the endpoints of its provider, backends that are gone
+// drain before they are dropped
+func (s *Server) reloadPool(pool *ModelPool) {
+	serverPool := pool.serverPool
+	serverEndpoint, err := pool.llmProvider.GetEndpoints()
 	if err != nil {
-		log.Printf("GetEndpoints err: %v\n", err)
+		log.Printf("[%s] GetEndpoints err: %v\n", pool.Name, err)
+		s.metrics.providerErrors.WithLabelValues(pool.Name, "get_endpoints").Inc()
 		return
 	}
 
+	s.metrics.endpoints.WithLabelValues(pool.Name).Set(float64(len(serverEndpoint)))
 	if len(serverEndpoint) == 0 {
-		log.Printf("Please provide one or more backends to load balance")
-		return
+		// the provider has no instances left, the backends of the gone ones are drained below
+		log.Printf("[%s] Please provide one or more backends to load balance", pool.Name)
 	}
 
-	log.Printf("Loading endpoints size: %d\n", len(serverEndpoint))
+	log.Printf("[%s] Loading endpoints size: %d\n", pool.Name, len(serverEndpoint))
+	var backends []*Backend
 	for _, endpoint := range serverEndpoint {
-		//goland:noinspection HttpUrlsUsage
-		serverUrl, err := url.Parse(fmt.Sprintf("http://%s:%d", endpoint.Host, endpoint.Port))
+		backend, err := s.newBackend(pool, endpoint)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("[%s] endpoint %s: %v\n", pool.Name, endpoint.ID, err)
+			continue
 		}
+		backends = append(backends, backend)
+	}
 
-		proxy := httputil.NewSingleHostReverseProxy(serverUrl)
-		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, err error) {
+	added := serverPool.Sync(backends)
+	for _, backend := range added {
+		log.Printf("host %s found\n", backend.URL)
+	}
+	// new backends start alive, check them right away rather than at the next health check
+	serverPool.checkBackends(added)
+}
 
-			statusCode := http.StatusInternalServerError
-			if e, ok := err.(net.Error); ok {
-				if e.Timeout() {
-					statusCode = http.StatusGatewayTimeout
-				} else {
-					statusCode = http.StatusBadGateway
-				}
-			} else if err == io.EOF {
+// newBackend creates the backend proxying to endpoint
+func (s *Server) newBackend(pool *ModelPool, endpoint provider.ServerEndpoint) (*Backend, error) {
+	serverPool := pool.serverPool
+	//goland:noinspection HttpUrlsUsage
+	serverUrl, err := url.Parse(fmt.Sprintf("http://%s:%d", endpoint.Host, endpoint.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &Backend{
+		ID:             endpoint.ID,
+		URL:            serverUrl,
+		Alive:          true,
+		GPUName:        endpoint.GPUName,
+		CPUName:        endpoint.CPUName,
+		Origin:         endpoint.Origin,
+		Weight:         endpoint.Weight,
+		MaxConcurrency: s.backendConcurrency(endpoint),
+		PricePerHour:   endpoint.PricePerHour,
+		HealthCheckURL: "/v1/internal/model/info",
+		Model:          endpoint.Model,
+	}
+	if s.breakerThreshold > 0 {
+		cooldown := s.breakerCooldown
+		backend.breaker = NewCircuitBreaker(s.breakerThreshold, cooldown, func(from, to BreakerState) {
+			log.Printf("[%s] %s circuit %s -> %s\n", pool.Name, serverUrl.Host, from, to)
+			switch to {
+			case BreakerOpen:
+				// hand queued requests the probe once the cooldown is over
+				time.AfterFunc(cooldown, serverPool.Dispatch)
+			case BreakerClosed:
+				serverPool.Dispatch()
+			}
+		})
+	}
+	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	proxy.Transport = s.getTransport()
+	// flush every write so streamed tokens reach the client immediately
+	proxy.FlushInterval = -1
+	proxy.ModifyResponse = s.modifyResponse(backend)
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, err error) {
+
+		statusCode := http.StatusInternalServerError
+		if e, ok := err.(net.Error); ok {
+			if e.Timeout() {
+				statusCode = http.StatusGatewayTimeout
+			} else {
 				statusCode = http.StatusBadGateway
-			} else if errors.Is(err, context.Canceled) {
-				statusCode = 499
-				writer.WriteHeader(statusCode)
-				return
 			}
+		} else if err == io.EOF {
+			statusCode = http.StatusBadGateway
+		} else if errors.Is(err, context.Canceled) {
+			statusCode = 499
+			backend.breakerCancel()
+			writer.WriteHeader(statusCode)
+			return
+		}
 
-			log.Printf("[%s] %s %s\n", serverUrl.Host, request.URL.RequestURI(), err.Error())
-			retries := GetRetryFromContext(request)
-			if retries < 3 {
-				select {
-				case <-time.After(10 * time.Millisecond):
-					ctx := context.WithValue(request.Context(), Retry, retries+1)
-
-					if request.GetBody != nil {
-						b, _ := request.GetBody()
-						request.Body = b
-					}
-					proxy.ServeHTTP(writer, request.WithContext(ctx))
-					if request.Body != nil {
-						_, ok := request.Body.(*fakeCloseReadCloser)
-						if ok {
-							_ = request.Body.(*fakeCloseReadCloser).RealClose()
-						}
+		log.Printf("[%s] %s %s\n", serverUrl.Host, request.URL.RequestURI(), err.Error())
+		backend.breakerResult(false)
+		if recorder, ok := request.Context().Value(usageRecorderContext).(*usageRecorder); ok {
+			recorder.retry()
+		}
+		retries := GetRetryFromContext(request)
+		// an open circuit sends the request to another backend straight away
+		if retries < 3 && backend.CircuitState() != BreakerOpen {
+			s.metrics.retries.WithLabelValues(pool.Name, serverUrl.Host).Inc()
+			select {
+			case <-time.After(10 * time.Millisecond):
+				ctx := context.WithValue(request.Context(), Retry, retries+1)
+
+				if request.GetBody != nil {
+					b, _ := request.GetBody()
+					request.Body = b
+				}
+				proxy.ServeHTTP(writer, request.WithContext(ctx))
+				if request.Body != nil {
+					_, ok := request.Body.(*fakeCloseReadCloser)
+					if ok {
+						_ = request.Body.(*fakeCloseReadCloser).RealClose()
 					}
 				}
-				return
 			}
+			return
+		}
 
-			// after 3 retries, mark this backend as down
+		// after 3 retries, mark this backend as down unless its circuit breaker takes care of it
+		if backend.breaker == nil {
 			serverPool.MarkBackendStatus(serverUrl, false)
 			log.Printf("%s [%s]\n", serverUrl.String(), "down")
+		}
 
-			// if the same request routing for few attempts with different backends, increase the count
-			attempts := GetAttemptsFromContext(request)
-			log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
-			ctx := context.WithValue(request.Context(), Attempts, attempts+1)
-			r := request.WithContext(ctx)
-			if r.GetBody != nil {
-				b, _ := r.GetBody()
-				r.Body = b
-			}
-			s.lb(writer, r)
-			if r.Body != nil {
-				_, ok := r.Body.(*fakeCloseReadCloser)
-				if ok {
-					_ = r.Body.(*fakeCloseReadCloser).RealClose()
-				}
+		// if the same request routing for few attempts with different backends, increase the count
+		attempts := GetAttemptsFromContext(request)
+		s.metrics.attempts.WithLabelValues(pool.Name, serverUrl.Host).Inc()
+		log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
+		ctx := context.WithValue(request.Context(), Attempts, attempts+1)
+		r := request.WithContext(ctx)
+		if r.GetBody != nil {
+			b, _ := r.GetBody()
+			r.Body = b
+		}
+		s.lb(writer, r)
+		if r.Body != nil {
+			_, ok := r.Body.(*fakeCloseReadCloser)
+			if ok {
+				_ = r.Body.(*fakeCloseReadCloser).RealClose()
 			}
 		}
-
-		serverPool.AddBackend(&Backend{
-			URL:            serverUrl,
-			Alive:          true,
-			ReverseProxy:   proxy,
-			HealthCheckURL: "/v1/internal/model/info",
-		})
-		log.Printf("host %s found\n", serverUrl)
-	}
-
-	if s.serverPool != nil {
-		s.serverPool.Destroy()
 	}
 
-	s.serverPool = serverPool
-	s.serverPool.HealthCheck()
-	// start health checking
-	go healthCheck(s.serverPool)
+	backend.ReverseProxy = proxy
+	return backend, nil
 }
 
 func (s *Server) Run(port int) {
 	// load backends
 	s.ReloadBackend()
-	// create http server
+	for _, pool := range s.pools {
+		go healthCheck(pool.serverPool)
+		if pool.autoscaler != nil {
+			go pool.autoscaler.Run()
+		}
+	}
+	// create http server, without a write timeout so long streams are not cut off
 	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: http.HandlerFunc(s.lb),
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 30 * time.Second,
 	}
 
 	go s.SyncBackend()
-	log.Printf("Model %s", s.llmProvider.GetModel())
+	for _, pool := range s.pools {
+		log.Printf("Model %s", pool.Name)
+	}
 	log.Printf("Load Balancer started at :%d\n", port)
 
 	go func() {
@@ -179,6 +442,20 @@ func (s *Server) Run(port int) {
 
 }
 
+// Handler returns the gateway http handler
+func (s *Server) Handler() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("/v1/models", s.listModels)
+	api.HandleFunc("/v1/models/", s.listModels)
+	api.HandleFunc("/", s.lb)
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", s.adminHandler())
+	mux.Handle("/metrics", s.metrics.Handler())
+	mux.Handle("/", s.trace(s.authenticate(api)))
+	return requestID(s.observe(mux))
+}
+
 // lb load balances the incoming request
 func (s *Server) lb(w http.ResponseWriter, r *http.Request) {
 	attempts := GetAttemptsFromContext(r)
@@ -187,17 +464,10 @@ func (s *Server) lb(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Service not available", http.StatusServiceUnavailable)
 		return
 	}
-
-	peer := s.serverPool.GetNextPeer()
-
-	if peer == nil {
-		http.Error(w, "Service not available", http.StatusServiceUnavailable)
-		return
-	}
-	startTime := time.Now()
-
+	entry := getRequestLog(r)
+	var bodyBytes []byte
 	if r.Body != nil {
-		bodyBytes, _ := io.ReadAll(r.Body)
+		bodyBytes, _ = io.ReadAll(r.Body)
 		r.Body = &fakeCloseReadCloser{io.NopCloser(bytes.NewBuffer(bodyBytes))}
 		r.GetBody = func() (io.ReadCloser, error) {
 			body := io.NopCloser(bytes.NewBuffer(bodyBytes))
@@ -216,18 +486,119 @@ func (s *Server) lb(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	entry.requestBytes = len(bodyBytes)
+	request := parseRequest(bodyBytes)
+	model := request.Model
+	pool := s.route(model)
+	if pool == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("The model `%s` does not exist", model),
+			"invalid_request_error", "model_not_found")
+		return
+	}
+	entry.model = pool.Name
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("llm.model", pool.Name))
+	key := GetAPIKeyFromContext(r)
+	if key != nil {
+		if !key.AllowsModel(model, pool.Name) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("Your API key is not allowed to use the model `%s`", pool.Name),
+				"invalid_request_error", "model_not_allowed")
+			return
+		}
+		// retries come back through lb, only the first attempt counts against the limits
+		if attempts == 1 && GetRetryFromContext(r) == 0 && !s.checkRateLimit(w, key, estimateTokens(bodyBytes, request)) {
+			return
+		}
+	}
+
+	// retries share the recorder of the first attempt, which records the usage once the response is done
+	recorder, retried := r.Context().Value(usageRecorderContext).(*usageRecorder)
+	if !retried {
+		recorder = newUsageRecorder()
+		r = r.WithContext(context.WithValue(r.Context(), usageRecorderContext, recorder))
+	}
+	entry.recorder = recorder
+
+	serverPool := pool.serverPool
+	ctx, span := tracer().Start(r.Context(), "queue")
+	peer, err := serverPool.Acquire(ctx)
+	if errors.Is(err, ErrNoBackend) && pool.autoscaler != nil && pool.autoscaler.coldStart() {
+		w, err = s.holdColdStart(w, r, pool, request.Stream)
+		if err == nil {
+			peer, err = serverPool.Acquire(ctx)
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.End()
+		s.queueError(w, r, err)
+		return
+	}
+	span.End()
+	defer serverPool.Release(peer)
+	startTime := time.Now()
+
 	peer.ReverseProxy.ServeHTTP(w, r)
 	since := time.Since(startTime)
 
-	s.logRequest(r, since, peer.URL.Host)
-	return
+	if !retried {
+		s.recordUsage(key, pool.Name, recorder, estimateTokens(bodyBytes, request), (len(bodyBytes)+3)/4, since)
+	}
+}
+
+// queueError replies to a request that didn't get a backend
+func (s *Server) queueError(w http.ResponseWriter, r *http.Request, err error) {
+	retryAfter := strconv.Itoa(int(math.Max(1, math.Ceil(s.queueTimeout.Seconds()))))
+	switch {
+	case errors.Is(err, ErrNoBackend):
+		http.Error(w, "Service not available", http.StatusServiceUnavailable)
+	case errors.Is(err, ErrQueueFull):
+		w.Header().Set("Retry-After", retryAfter)
+		writeError(w, http.StatusTooManyRequests, "The gateway is overloaded, please retry later",
+			"rate_limit_error", "queue_full")
+	case errors.Is(err, ErrColdStartTimeout):
+		w.Header().Set("Retry-After", "30")
+		writeError(w, http.StatusServiceUnavailable, "The model is starting, please retry later",
+			"server_error", "cold_start_timeout")
+	case errors.Is(err, provider.ErrBudgetExceeded):
+		w.Header().Set("Retry-After", "300")
+		writeError(w, http.StatusServiceUnavailable, "The model can't be started within the spend budget, please retry later",
+			"server_error", "budget_exceeded")
+	case errors.Is(err, ErrQueueTimeout):
+		w.Header().Set("Retry-After", retryAfter)
+		writeError(w, http.StatusServiceUnavailable, "Timed out waiting for a free backend, please retry later",
+			"server_error", "queue_timeout")
+	default:
+		// the client went away while queued
+		log.Printf("%s(%s) %v\n", r.RemoteAddr, r.URL.Path, err)
+	}
 }
 
-func (s *Server) logRequest(req *http.Request, elapsedTime time.Duration, backend string) {
-	clientIP := req.RemoteAddr
-	elapsedTimeFormatted := fmt.Sprintf("%.3f", elapsedTime.Seconds())
-	log.Printf("%s - [%s] \"%s %s\"  %s %s\n", clientIP, req.Method, req.URL.RequestURI(), req.Proto,
-		backend, elapsedTimeFormatted)
+// route returns the pool serving model, or the default pool when the request names no model
+func (s *Server) route(model string) *ModelPool {
+	if model == "" {
+		if len(s.pools) == 0 {
+			return nil
+		}
+		return s.pools[0]
+	}
+	return s.models[model]
+}
+
+// openAIRequest holds the fields of an OpenAI request body the gateway looks at
+type openAIRequest struct {
+	Model     string `json:"model"`
+	Stream    bool   `json:"stream"`
+	MaxTokens int    `json:"max_tokens"`
+	N         int    `json:"n"`
+}
+
+// parseRequest parses an OpenAI request body, other bodies give an empty request
+func parseRequest(body []byte) openAIRequest {
+	var request openAIRequest
+	if len(body) == 0 || json.Unmarshal(body, &request) != nil {
+		return openAIRequest{}
+	}
+	return request
 }
 
 // SyncBackend Scheduled synchronization of backend
@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stubProvider struct {
+	model     string
+	endpoints []provider.ServerEndpoint
+	replicas  int
+	err       error
+}
+
+func (s *stubProvider) GetEndpoints() ([]provider.ServerEndpoint, error) { return s.endpoints, s.err }
+func (s *stubProvider) GetModel() string                                 { return s.model }
+func (s *stubProvider) AutoScaling(replica int) error                    { s.replicas = replica; return nil }
+func (s *stubProvider) DestroyInstance(id string) error                  { return provider.ErrNotSupported }
+func (s *stubProvider) StopInstance(id string) error                     { return provider.ErrNotSupported }
+func (s *stubProvider) StartInstance(id string) error                    { return provider.ErrNotSupported }
+func (s *stubProvider) RebootInstance(id string) error                   { return provider.ErrNotSupported }
+
+// newBackend starts a fake text-generation-webui serving the model name with loras,
+// it answers every other request with the model name
+func newBackend(t *testing.T, name string, loras ...string) provider.ServerEndpoint {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/v1/internal/model/info" {
+			info := provider.LLMModelInfoResponse{ModelName: name}
+			for _, lora := range loras {
+				info.LoraNames = append(info.LoraNames, lora)
+			}
+			_ = json.NewEncoder(w).Encode(info)
+			return
+		}
+		_, _ = fmt.Fprint(w, name)
+	}))
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return provider.ServerEndpoint{ID: name, Host: u.Hostname(), Port: port, Model: name}
+}
+
+func newTestServer(t *testing.T, llmProviders ...provider.LLMProvider) (*Server, *httptest.Server) {
+	s := NewProxyServer(llmProviders...)
+	s.ReloadBackend()
+	t.Cleanup(func() {
+		for _, pool := range s.pools {
+			pool.serverPool.Destroy()
+		}
+	})
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func TestServer_ModelRouting(t *testing.T) {
+	s, server := newTestServer(t,
+		&stubProvider{model: "llama", endpoints: []provider.ServerEndpoint{newBackend(t, "llama")}},
+		&stubProvider{model: "mixtral", endpoints: []provider.ServerEndpoint{newBackend(t, "mixtral")}},
+	)
+	if err := s.AddAlias("gpt-3.5-turbo", "mixtral"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddAlias("gpt-3.5-turbo", "llama"); err == nil {
+		t.Error("expected error for alias used twice")
+	}
+
+	tests := []struct {
+		body       string
+		statusCode int
+		backend    string
+	}{
+		{`{"model": "mixtral", "messages": []}`, http.StatusOK, "mixtral"},
+		{`{"model": "llama", "messages": []}`, http.StatusOK, "llama"},
+		{`{"model": "gpt-3.5-turbo", "messages": []}`, http.StatusOK, "mixtral"},
+		{`{"messages": []}`, http.StatusOK, "llama"},
+		{`{"model": "gpt-4", "messages": []}`, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		response, err := http.Post(server.URL+"/v1/chat/completions", "application/json", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		if response.StatusCode != tt.statusCode {
+			t.Errorf("%s: status %d, want %d", tt.body, response.StatusCode, tt.statusCode)
+			continue
+		}
+		if tt.statusCode != http.StatusOK {
+			var errorResponse ErrorResponse
+			if err := json.Unmarshal(body, &errorResponse); err != nil || errorResponse.Error.Code != "model_not_found" {
+				t.Errorf("%s: unexpected error body %s", tt.body, body)
+			}
+			continue
+		}
+		if string(body) != tt.backend {
+			t.Errorf("%s: routed to %s, want %s", tt.body, body, tt.backend)
+		}
+	}
+}
+
+func TestServer_ListModels(t *testing.T) {
+	s, server := newTestServer(t,
+		&stubProvider{model: "llama", endpoints: []provider.ServerEndpoint{newBackend(t, "llama")}},
+		&stubProvider{model: "mixtral", endpoints: []provider.ServerEndpoint{
+			newBackend(t, "mixtral", "sql-lora"),
+			newBackend(t, "mixtral"),
+		}},
+	)
+	if err := s.AddAlias("gpt-3.5-turbo", "mixtral"); err != nil {
+		t.Fatal(err)
+	}
+
+	listModels := func(server *httptest.Server) (string, []string) {
+		response, err := http.Get(server.URL + "/v1/models")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		data, _ := io.ReadAll(response.Body)
+		var list ModelList
+		if err := json.Unmarshal(data, &list); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, model := range list.Data {
+			got = append(got, fmt.Sprintf("%s/%s/%d%v", model.ID, model.Root, model.Replicas, model.Loras))
+		}
+		return string(data), got
+	}
+	// loras are listed on their pool, only routed names are model ids
+	_, got := listModels(server)
+	want := "[llama//1[] mixtral//2[sql-lora] gpt-3.5-turbo/mixtral/2[]]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("models %v, want %s", got, want)
+	}
+
+	// draining backends take no requests and don't count
+	s.pools[0].serverPool.Backends()[0].SetDraining(true)
+	s.pools[1].serverPool.Backends()[1].SetDraining(true)
+	if _, got := listModels(server); fmt.Sprint(got) != "[llama//0[] mixtral//1[sql-lora] gpt-3.5-turbo/mixtral/1[]]" {
+		t.Errorf("models %v with draining backends", got)
+	}
+	_, empty := newTestServer(t)
+	if body, _ := listModels(empty); !strings.Contains(body, `"data":[]`) {
+		t.Errorf("model list %s without models, want an empty data array", body)
+	}
+
+	response, err := http.Get(server.URL + "/v1/models/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("status %d, want 404", response.StatusCode)
+	}
+}
+
+func TestServer_ReloadDrains(t *testing.T) {
+	// the slow backend holds its completion until release is closed
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/v1/internal/model/info" {
+			_, _ = fmt.Fprint(w, `{"model_name": "slow"}`)
+			return
+		}
+		close(started)
+		<-release
+		_, _ = fmt.Fprint(w, "slow")
+	}))
+	t.Cleanup(slow.Close)
+	u, _ := url.Parse(slow.URL)
+	port, _ := strconv.Atoi(u.Port())
+	slowEndpoint := provider.ServerEndpoint{ID: "slow", Host: u.Hostname(), Port: port}
+	kept, added := newBackend(t, "kept"), newBackend(t, "added")
+
+	llmProvider := &stubProvider{model: "llama", endpoints: []provider.ServerEndpoint{slowEndpoint, kept}}
+	s, server := newTestServer(t, llmProvider)
+	serverPool := s.pools[0].serverPool
+	keptBackend := serverPool.Backends()[1]
+	keptBackend.SetDraining(true)
+
+	done := make(chan string)
+	go func() {
+		response, err := http.Post(server.URL+"/v1/completions", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		done <- string(body)
+	}()
+	<-started
+
+	kept.Weight = 3
+	llmProvider.endpoints = []provider.ServerEndpoint{kept, added}
+	s.ReloadBackend()
+	backends := serverPool.Backends()
+	if len(backends) != 3 {
+		t.Fatalf("%d backends after reload, want 3", len(backends))
+	}
+	if backends[0] != keptBackend || !keptBackend.IsDraining() || keptBackend.weight() != 3 {
+		t.Errorf("surviving backend lost its state or settings")
+	}
+	if checkedAt, _ := backends[1].LastHealthCheck(); backends[1].ID != "added" || !backends[1].IsAlive() || checkedAt.IsZero() {
+		t.Errorf("added backend %+v is not health checked", backends[1])
+	}
+	if backends[2].ID != "slow" || !backends[2].IsRetired() || !backends[2].IsDraining() {
+		t.Errorf("removed backend with a request in flight is not draining")
+	}
+	// a backend drained by hand stays drained when the provider reports it again
+	slowBackend := backends[2]
+	slowBackend.SetDraining(true)
+	llmProvider.endpoints = []provider.ServerEndpoint{kept, added, slowEndpoint}
+	s.ReloadBackend()
+	if slowBackend.IsRetired() || !slowBackend.IsDraining() {
+		t.Errorf("backend drained by hand is back in rotation")
+	}
+	llmProvider.endpoints = []provider.ServerEndpoint{kept, added}
+	s.ReloadBackend()
+
+	close(release)
+	if got := <-done; got != "slow" {
+		t.Fatalf("in-flight request on the removed backend got %q", got)
+	}
+	// the backend is released after the response is written
+	deadline := time.Now().Add(time.Second)
+	for len(serverPool.Backends()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	backends = serverPool.Backends()
+	if len(backends) != 2 || backends[0] != keptBackend || backends[1].ID != "added" {
+		t.Errorf("drained backend is still in the pool")
+	}
+
+	// a failing provider keeps the backends, one without instances drops them
+	llmProvider.err = errors.New("api down")
+	s.ReloadBackend()
+	if backends = serverPool.Backends(); len(backends) != 2 {
+		t.Errorf("%d backends after a failed reload, want 2", len(backends))
+	}
+	llmProvider.endpoints, llmProvider.err = nil, nil
+	s.ReloadBackend()
+	if backends = serverPool.Backends(); len(backends) != 0 {
+		t.Errorf("%d backends after the instances are gone, want none", len(backends))
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errStreamIdle = errors.New("stream idle timeout")
+
+// isEventStream reports whether the response is a server-sent events stream
+func isEventStream(response *http.Response) bool {
+	return isEventStreamHeader(response.Header)
+}
+
+func isEventStreamHeader(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+}
+
+// modifyResponse counts the tokens of a response of backend and prepares SSE responses for
+// proxying chunk by chunk
+func (s *Server) modifyResponse(backend *Backend) func(*http.Response) error {
+	return func(response *http.Response) error {
+		recorder, ok := response.Request.Context().Value(usageRecorderContext).(*usageRecorder)
+		if !ok {
+			recorder = newUsageRecorder()
+		}
+		recorder.responded(backend)
+		backend.breakerResult(response.StatusCode < http.StatusInternalServerError)
+
+		if !isEventStream(response) {
+			response.Body = &usageBody{ReadCloser: response.Body, recorder: recorder}
+			return nil
+		}
+		// stop proxies in front of the gateway from buffering the stream
+		response.Header.Set("X-Accel-Buffering", "no")
+		response.Header.Set("Cache-Control", "no-cache")
+		response.Header.Del("Content-Length")
+		response.ContentLength = -1
+		response.Body = newStreamBody(response.Body, s.streamIdleTimeout, backend, recorder)
+		return nil
+	}
+}
+
+// streamBody passes complete SSE events through and ends the stream with an error event when the
+// backend fails or stays silent for longer than the idle timeout, instead of truncating the connection.
+type streamBody struct {
+	body     io.ReadCloser
+	backend  *Backend
+	recorder *usageRecorder
+	timeout  time.Duration
+	timer    *time.Timer
+
+	mux     sync.Mutex
+	idle    bool
+	pending []byte // read from the backend, not yet a complete event
+	out     []byte // complete events and the error event waiting to be returned
+	done    bool
+}
+
+func newStreamBody(body io.ReadCloser, timeout time.Duration, backend *Backend, recorder *usageRecorder) *streamBody {
+	b := &streamBody{body: body, backend: backend, recorder: recorder, timeout: timeout}
+	if timeout > 0 {
+		b.timer = time.AfterFunc(timeout, b.expire)
+	}
+	return b
+}
+
+// expire closes the backend body to unblock a pending Read
+func (b *streamBody) expire() {
+	b.mux.Lock()
+	b.idle = true
+	b.mux.Unlock()
+	_ = b.body.Close()
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+		b.fill()
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+// fill reads the next chunk from the backend and moves complete events to out
+func (b *streamBody) fill() {
+	buf := make([]byte, 4096)
+	n, err := b.body.Read(buf)
+	if n > 0 && b.timer != nil {
+		b.timer.Reset(b.timeout)
+	}
+	b.pending = append(b.pending, buf[:n]...)
+	if end := eventBoundary(b.pending); end > 0 {
+		b.recorder.observeEvents(b.pending[:end])
+		b.out = append(b.out, b.pending[:end]...)
+		b.pending = b.pending[end:]
+	}
+	if err == nil {
+		return
+	}
+
+	b.done = true
+	b.stopTimer()
+	b.mux.Lock()
+	if b.idle {
+		err = errStreamIdle
+	}
+	b.mux.Unlock()
+	if err == io.EOF {
+		b.recorder.observeEvents(b.pending)
+		b.out = append(b.out, b.pending...)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// the client went away, nobody is left to read the error
+		return
+	}
+	log.Printf("[%s] stream interrupted: %v\n", b.backend.URL.Host, err)
+	b.backend.breakerResult(false)
+	b.out = append(b.out, errorEvent(fmt.Sprintf("backend stream interrupted: %v", err))...)
+}
+
+func (b *streamBody) stopTimer() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+func (b *streamBody) Close() error {
+	b.stopTimer()
+	return b.body.Close()
+}
+
+// eventBoundary returns the end of the last complete event in data, 0 if there is none
+func eventBoundary(data []byte) int {
+	end := 0
+	for _, sep := range [][]byte{[]byte("\n\n"), []byte("\r\n\r\n"), []byte("\r\r")} {
+		if i := bytes.LastIndex(data, sep); i >= 0 && i+len(sep) > end {
+			end = i + len(sep)
+		}
+	}
+	return end
+}
+
+// errorEvent is an OpenAI style error as an SSE event
+func errorEvent(message string) []byte {
+	data, _ := json.Marshal(ErrorResponse{
+		Error: ErrorDetail{
+			Message: message,
+			Type:    "server_error",
+			Code:    "backend_error",
+		},
+	})
+	return []byte(fmt.Sprintf("data: %s\n\n", data))
+}
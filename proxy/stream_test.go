@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStreamBackend starts a backend that streams events, waiting on next before each one,
+// and then either hangs or drops the connection after writing half an event
+func newStreamBackend(t *testing.T, events []string, next chan struct{}, drop bool) provider.ServerEndpoint {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/internal/model/info" {
+			_, _ = fmt.Fprint(w, `{"model_name": "mixtral"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		for _, event := range events {
+			<-next
+			_, _ = fmt.Fprintf(w, "data: %s\r\n\r\n", event)
+			w.(http.Flusher).Flush()
+		}
+		if drop {
+			_, _ = fmt.Fprint(w, `data: {"choices": [{"del`)
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		}
+		<-done
+	}))
+	t.Cleanup(func() {
+		close(done)
+		server.Close()
+	})
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return provider.ServerEndpoint{ID: "stream", Host: u.Hostname(), Port: port}
+}
+
+func readStream(t *testing.T, server *httptest.Server, next chan struct{}) []string {
+	response, err := http.Post(server.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model": "mixtral", "stream": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("X-Accel-Buffering") != "no" {
+		t.Error("missing X-Accel-Buffering header")
+	}
+
+	var events []string
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			events = append(events, line)
+			// the next event is only sent once this one arrived, so a buffering proxy deadlocks
+			select {
+			case next <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return events
+}
+
+func TestServer_StreamIdleTimeout(t *testing.T) {
+	next := make(chan struct{}, 1)
+	next <- struct{}{}
+	backend := newStreamBackend(t, []string{`{"id": 1}`, `{"id": 2}`}, next, false)
+	s, server := newTestServer(t, &stubProvider{model: "mixtral", endpoints: []provider.ServerEndpoint{backend}})
+	s.SetStreamIdleTimeout(200 * time.Millisecond)
+
+	events := readStream(t, server, next)
+	if len(events) != 3 || events[0] != `data: {"id": 1}` || events[1] != `data: {"id": 2}` {
+		t.Fatalf("unexpected events: %q", events)
+	}
+	if !strings.Contains(events[2], `"code":"backend_error"`) || !strings.Contains(events[2], errStreamIdle.Error()) {
+		t.Errorf("unexpected error event: %s", events[2])
+	}
+}
+
+func TestServer_StreamBackendDropped(t *testing.T) {
+	next := make(chan struct{}, 1)
+	next <- struct{}{}
+	backend := newStreamBackend(t, []string{`{"id": 1}`}, next, true)
+	_, server := newTestServer(t, &stubProvider{model: "mixtral", endpoints: []provider.ServerEndpoint{backend}})
+
+	events := readStream(t, server, next)
+	if len(events) != 2 || events[0] != `data: {"id": 1}` {
+		t.Fatalf("unexpected events: %q", events)
+	}
+	if !strings.HasPrefix(events[1], `data: {"error":`) {
+		t.Errorf("half event not replaced by an error event: %s", events[1])
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"sync"
+)
+
+const tracerName = "github.com/beyondblog/llm-api-gateway/proxy"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// trace starts the span of an inbound request, continuing the trace of an incoming traceparent
+func (s *Server) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, fmt.Sprintf("%s %s", r.Method, r.URL.Path),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.Path),
+				attribute.String("net.sock.peer.addr", r.RemoteAddr),
+			))
+		defer span.End()
+
+		sw := newStatusWriter(w)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// tracingTransport records a span for every request sent to a backend, including the retries of
+// the ErrorHandler and the attempts on other backends, and propagates the trace to the backend
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer().Start(req.Context(), "backend "+req.URL.Host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.target", req.URL.Path),
+			attribute.String("backend.host", req.URL.Host),
+			attribute.Int("gateway.attempt", GetAttemptsFromContext(req)),
+			attribute.Int("gateway.retry", GetRetryFromContext(req)),
+		))
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	response, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.status_code", response.StatusCode))
+	if response.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(response.StatusCode))
+	}
+	// the attempt lasts until the response, a stream included, has been read
+	response.Body = &spanBody{ReadCloser: response.Body, span: span}
+	return response, nil
+}
+
+// spanBody ends the span of a backend attempt when its response body is closed
+type spanBody struct {
+	io.ReadCloser
+	span trace.Span
+	once sync.Once
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.span.End() })
+	return err
+}
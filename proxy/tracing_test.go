@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"github.com/beyondblog/llm-api-gateway/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace/noop"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// collector is an in-process OTLP/HTTP trace collector
+type collector struct {
+	mux   sync.Mutex
+	spans []*tracepb.Span
+}
+
+func newCollector(t *testing.T) (*collector, string) {
+	c := new(collector)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var request collectortrace.ExportTraceServiceRequest
+		if r.URL.Path != "/v1/traces" || proto.Unmarshal(data, &request) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.mux.Lock()
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				c.spans = append(c.spans, scopeSpans.Spans...)
+			}
+		}
+		c.mux.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		response, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+		_, _ = w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	return c, server.URL
+}
+
+func (c *collector) find(name string) []*tracepb.Span {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var spans []*tracepb.Span
+	for _, span := range c.spans {
+		if strings.HasPrefix(span.Name, name) {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func spanAttribute(span *tracepb.Span, key string) string {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			if v := attr.Value.GetStringValue(); v != "" {
+				return v
+			}
+			return strconv.FormatInt(attr.Value.GetIntValue(), 10)
+		}
+	}
+	return ""
+}
+
+func TestServer_Tracing(t *testing.T) {
+	c, endpoint := newCollector(t)
+	shutdown, err := utils.SetupTracing(endpoint, "llm-api-gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	// the backend drops the connection of the first completion request, the retry succeeds
+	var completions int32
+	var traceparent atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/v1/internal/model/info" {
+			_, _ = fmt.Fprint(w, `{"model_name": "llama"}`)
+			return
+		}
+		if atomic.AddInt32(&completions, 1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		}
+		traceparent.Store(r.Header.Get("traceparent"))
+		_, _ = fmt.Fprint(w, "llama")
+	}))
+	t.Cleanup(backend.Close)
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+	_, server := newTestServer(t, &stubProvider{model: "llama", endpoints: []provider.ServerEndpoint{
+		{ID: "llama", Host: u.Hostname(), Port: port, Model: "llama"},
+	}})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/chat/completions", strings.NewReader(`{"model": "llama"}`))
+	request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK || string(body) != "llama" {
+		t.Fatalf("status %d, body %s", response.StatusCode, body)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := traceparent.Load().(string); !strings.Contains(got, traceID) {
+		t.Errorf("backend traceparent %q, want trace %s", got, traceID)
+	}
+	inbound := c.find("POST /v1/chat/completions")
+	if len(inbound) != 1 {
+		t.Fatalf("%d inbound spans, want 1", len(inbound))
+	}
+	if got := hex.EncodeToString(inbound[0].TraceId); got != traceID {
+		t.Errorf("inbound trace %s, want %s", got, traceID)
+	}
+	if got := spanAttribute(inbound[0], "llm.model"); got != "llama" {
+		t.Errorf("inbound model %q, want llama", got)
+	}
+	attempts := c.find("backend ")
+	if len(attempts) != 2 {
+		t.Fatalf("%d backend spans, want 2", len(attempts))
+	}
+	for i, span := range attempts {
+		if hex.EncodeToString(span.TraceId) != traceID || string(span.ParentSpanId) != string(inbound[0].SpanId) {
+			t.Errorf("backend span %d is not a child of the inbound span", i)
+		}
+		if got := spanAttribute(span, "gateway.retry"); got != strconv.Itoa(i) {
+			t.Errorf("backend span %d retry %s, want %d", i, got, i)
+		}
+		if got := spanAttribute(span, "backend.host"); got != u.Host {
+			t.Errorf("backend span %d host %s, want %s", i, got, u.Host)
+		}
+	}
+	if attempts[0].Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR {
+		t.Errorf("failed attempt status %v, want error", attempts[0].Status)
+	}
+}
@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxUsageBody bounds the non-streamed response bytes kept to find the usage block
+const maxUsageBody = 4 << 20
+
+var usageBucket = []byte("usage")
+
+// Usage is the OpenAI usage block
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// usageRecorder collects the token usage of one proxied response
+type usageRecorder struct {
+	mux     sync.Mutex
+	backend *Backend // the backend that responded
+	shared  int64    // requests the backend was serving when it responded
+	usage   *Usage   // reported by the backend
+	chunks  int      // streamed chunks carrying generated text
+	retries int      // requests sent again to the same or another backend
+}
+
+func newUsageRecorder() *usageRecorder {
+	return new(usageRecorder)
+}
+
+// responded notes the backend answering the request, earlier attempts are forgotten
+func (u *usageRecorder) responded(backend *Backend) {
+	u.mux.Lock()
+	u.backend = backend
+	u.shared = backend.InFlight()
+	u.usage = nil
+	u.chunks = 0
+	u.mux.Unlock()
+}
+
+// retry counts a request sent again after a backend failed
+func (u *usageRecorder) retry() {
+	u.mux.Lock()
+	u.retries++
+	u.mux.Unlock()
+}
+
+func (u *usageRecorder) retryCount() int {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return u.retries
+}
+
+// observeEvents counts the SSE events of a streamed completion, each chunk is one token
+func (u *usageRecorder) observeEvents(events []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(events))
+	scanner.Buffer(make([]byte, 64*1024), maxUsageBody)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "data:")
+		if !ok {
+			continue
+		}
+		var chunk struct {
+			Usage   *Usage `json:"usage"`
+			Choices []struct {
+				Text  string `json:"text"`
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if json.Unmarshal([]byte(strings.TrimSpace(data)), &chunk) != nil {
+			continue
+		}
+		u.mux.Lock()
+		if chunk.Usage != nil {
+			u.usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Text != "" || choice.Delta.Content != "" {
+				u.chunks++
+			}
+		}
+		u.mux.Unlock()
+	}
+}
+
+// observeBody reads the usage block of a non-streamed response
+func (u *usageRecorder) observeBody(body []byte) {
+	var response struct {
+		Usage *Usage `json:"usage"`
+	}
+	if json.Unmarshal(body, &response) != nil || response.Usage == nil {
+		return
+	}
+	u.mux.Lock()
+	u.usage = response.Usage
+	u.mux.Unlock()
+}
+
+// result returns the usage of the response, the backend that served it, nil if no backend responded,
+// and the requests it was serving. Prompt tokens are estimated when the backend reported none.
+func (u *usageRecorder) result(estimatedPrompt int) (Usage, *Backend, int64) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if u.backend == nil {
+		return Usage{}, nil, 0
+	}
+	if u.usage != nil {
+		usage := *u.usage
+		if usage.TotalTokens == 0 {
+			usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+		}
+		return usage, u.backend, u.shared
+	}
+	return Usage{
+		PromptTokens:     estimatedPrompt,
+		CompletionTokens: u.chunks,
+		TotalTokens:      estimatedPrompt + u.chunks,
+	}, u.backend, u.shared
+}
+
+// recordUsage corrects the rate limit estimate of key with the actual usage and stores it. The cost is
+// the backend price over the request duration, shared with the requests it served at the same time.
+func (s *Server) recordUsage(key *APIKey, model string, recorder *usageRecorder, estimated, estimatedPrompt int, elapsed time.Duration) {
+	usage, backend, shared := recorder.result(estimatedPrompt)
+	if backend == nil {
+		return
+	}
+	if key != nil {
+		s.rateLimiter.Adjust(key, estimated, usage.TotalTokens)
+	}
+	if s.usage == nil {
+		return
+	}
+
+	if shared < 1 {
+		shared = 1
+	}
+	record := UsageRecord{
+		Time:    time.Now(),
+		Key:     "anonymous",
+		Model:   model,
+		Backend: backend.URL.Host,
+		Usage:   usage,
+		Cost:    backend.PricePerHour * elapsed.Hours() / float64(shared),
+	}
+	if key != nil {
+		record.Key = key.ID()
+	}
+	if err := s.usage.Record(record); err != nil {
+		log.Printf("record usage err: %v\n", err)
+	}
+}
+
+// usageBody keeps a copy of a non-streamed response to read its usage block at the end
+type usageBody struct {
+	io.ReadCloser
+	recorder *usageRecorder
+	buf      bytes.Buffer
+}
+
+func (b *usageBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.buf.Len()+n <= maxUsageBody {
+		b.buf.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.recorder.observeBody(b.buf.Bytes())
+	}
+	return n, err
+}
+
+// UsageRecord is the usage of one request
+type UsageRecord struct {
+	Time    time.Time
+	Key     string
+	Model   string
+	Backend string
+	Usage   Usage
+	Cost    float64 // $
+}
+
+// UsageEntry is the usage summed over the hours of a report for one key, model and backend
+type UsageEntry struct {
+	Key              string  `json:"key"`
+	Model            string  `json:"model"`
+	Backend          string  `json:"backend"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+func (e *UsageEntry) add(other UsageEntry) {
+	e.Requests += other.Requests
+	e.PromptTokens += other.PromptTokens
+	e.CompletionTokens += other.CompletionTokens
+	e.TotalTokens += other.TotalTokens
+	e.Cost += other.Cost
+}
+
+// UsageStore keeps hourly usage per key, model and backend in a local bbolt database
+type UsageStore struct {
+	db *bbolt.DB
+}
+
+func OpenUsageStore(path string) (*UsageStore, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open usage store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usageBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &UsageStore{db: db}, nil
+}
+
+func (u *UsageStore) Close() error {
+	return u.db.Close()
+}
+
+// usageKey sorts by hour first so a report is a range scan
+func usageKey(hour time.Time, key, model, backend string) []byte {
+	return []byte(strings.Join([]string{hour.UTC().Format("2006010215"), key, model, backend}, "\x00"))
+}
+
+// Record adds the usage of a request to its hour
+func (u *UsageStore) Record(record UsageRecord) error {
+	k := usageKey(record.Time.UTC().Truncate(time.Hour), record.Key, record.Model, record.Backend)
+	return u.db.Batch(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		entry := UsageEntry{Key: record.Key, Model: record.Model, Backend: record.Backend}
+		if data := b.Get(k); data != nil {
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+		}
+		entry.add(UsageEntry{
+			Requests:         1,
+			PromptTokens:     record.Usage.PromptTokens,
+			CompletionTokens: record.Usage.CompletionTokens,
+			TotalTokens:      record.Usage.TotalTokens,
+			Cost:             record.Cost,
+		})
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(k, data)
+	})
+}
+
+// Report sums the usage of the hours from from up to to, for one key or all keys when key is empty
+func (u *UsageStore) Report(key string, from, to time.Time) ([]UsageEntry, error) {
+	sums := make(map[string]*UsageEntry)
+	start := []byte(from.UTC().Truncate(time.Hour).Format("2006010215"))
+	end := []byte(to.UTC().Format("2006010215"))
+	err := u.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(usageBucket).Cursor()
+		for k, v := c.Seek(start); k != nil && bytes.Compare(k[:len(end)], end) <= 0; k, v = c.Next() {
+			var entry UsageEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if key != "" && entry.Key != key {
+				continue
+			}
+			id := strings.Join([]string{entry.Key, entry.Model, entry.Backend}, "\x00")
+			if sum, ok := sums[id]; ok {
+				sum.add(entry)
+			} else {
+				sums[id] = &entry
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]UsageEntry, 0, len(sums))
+	for _, entry := range sums {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		return a.Backend < b.Backend
+	})
+	return entries, nil
+}
+
+// UsageReport is the /admin/usage response
+type UsageReport struct {
+	Key   string       `json:"key,omitempty"`
+	From  time.Time    `json:"from"`
+	To    time.Time    `json:"to"`
+	Usage []UsageEntry `json:"usage"`
+	Total UsageEntry   `json:"total"`
+}
+
+// usageReport answers GET /admin/usage?key=&from=&to=, from and to are RFC3339 times or dates
+// and default to the start of the month and now
+func (s *Server) usageReport(w http.ResponseWriter, r *http.Request) {
+	if s.usage == nil {
+		writeError(w, http.StatusNotFound, "Usage accounting is disabled", "invalid_request_error", "usage_disabled")
+		return
+	}
+	now := time.Now().UTC()
+	from, err := parseReportTime(r.URL.Query().Get("from"), time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_from")
+		return
+	}
+	to, err := parseReportTime(r.URL.Query().Get("to"), now)
+	if len(r.URL.Query().Get("to")) == len("2006-01-02") {
+		// a date includes the whole day
+		to = to.Add(24*time.Hour - time.Nanosecond)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_to")
+		return
+	}
+
+	report := UsageReport{Key: r.URL.Query().Get("key"), From: from, To: to}
+	report.Usage, err = s.usage.Report(report.Key, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error(), "server_error", "usage_store_error")
+		return
+	}
+	for _, entry := range report.Usage {
+		report.Total.add(entry)
+	}
+	writeJSON(w, report)
+}
+
+func parseReportTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC3339 or YYYY-MM-DD", value)
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/beyondblog/llm-api-gateway/provider"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageStore(t *testing.T) {
+	store, err := OpenUsageStore(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	day := time.Date(2026, 10, 1, 10, 30, 0, 0, time.UTC)
+	records := []UsageRecord{
+		{Time: day, Key: "team-a", Model: "mixtral", Backend: "10.0.0.1:5000", Usage: Usage{10, 20, 30}, Cost: 0.5},
+		{Time: day.Add(time.Minute), Key: "team-a", Model: "mixtral", Backend: "10.0.0.1:5000", Usage: Usage{1, 2, 3}, Cost: 0.25},
+		{Time: day.Add(2 * time.Hour), Key: "team-b", Model: "mixtral", Backend: "10.0.0.1:5000", Usage: Usage{5, 5, 10}},
+		{Time: day.Add(48 * time.Hour), Key: "team-a", Model: "llama", Backend: "10.0.0.2:5000", Usage: Usage{1, 1, 2}},
+	}
+	for _, record := range records {
+		if err := store.Record(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := store.Report("team-a", day.Add(-time.Hour), day.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := UsageEntry{Key: "team-a", Model: "mixtral", Backend: "10.0.0.1:5000", Requests: 2,
+		PromptTokens: 11, CompletionTokens: 22, TotalTokens: 33, Cost: 0.75}
+	if len(entries) != 1 || entries[0] != want {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+
+	entries, err = store.Report("", day, day.Add(72*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("got %d entries, want 3: %+v", len(entries), entries)
+	}
+}
+
+func TestServer_UsageAccounting(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/v1/internal/model/info" {
+			_, _ = fmt.Fprint(w, `{"model_name": "mixtral"}`)
+			return
+		}
+		if strings.Contains(string(body), `"stream": true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, token := range []string{"Hello", " world", "!"} {
+				_, _ = fmt.Fprintf(w, "data: {\"choices\": [{\"delta\": {\"content\": %q}}]}\n\n", token)
+			}
+			_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		_, _ = fmt.Fprint(w, `{"choices": [], "usage": {"prompt_tokens": 12, "completion_tokens": 30, "total_tokens": 42}}`)
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+	endpoint := provider.ServerEndpoint{ID: "mixtral", Host: u.Hostname(), Port: port, PricePerHour: 3600}
+
+	s, server := newTestServer(t, &stubProvider{model: "mixtral", endpoints: []provider.ServerEndpoint{endpoint}})
+	store, err := OpenUsageStore(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	s.SetUsageStore(store)
+	s.SetAdminToken("admin-secret")
+
+	for _, body := range []string{`{"model": "mixtral"}`, `{"model": "mixtral", "stream": true}`} {
+		response, err := http.Post(server.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+	}
+
+	request, _ := http.NewRequest("GET", server.URL+"/admin/usage?key=anonymous", nil)
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("admin api without token: %v %v", response, err)
+	}
+	request.Header.Set("Authorization", "Bearer admin-secret")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var report UsageReport
+	if err := json.NewDecoder(response.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	// 42 reported tokens, then 3 streamed chunks and a prompt of 36 bytes estimated at 9 tokens
+	if len(report.Usage) != 1 || report.Total.Requests != 2 || report.Total.CompletionTokens != 33 ||
+		report.Total.TotalTokens != 54 || report.Total.Cost <= 0 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
@@ -2,8 +2,8 @@ package utils
 
 import (
 	"bytes"
-	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"time"
 )
@@ -57,7 +57,7 @@ func PostHttpRequest(url string, header map[string]string, payload []byte) ([]by
 		defer func(Body io.ReadCloser) {
 			err = Body.Close()
 			if err != nil {
-				fmt.Errorf("close body error: %v", err)
+				log.Printf("close body error: %v", err)
 			}
 		}(response.Body)
 	}
@@ -89,7 +89,39 @@ func PutHttpRequest(url string, header map[string]string, payload []byte) ([]byt
 		defer func(Body io.ReadCloser) {
 			err = Body.Close()
 			if err != nil {
-				fmt.Errorf("close body error: %v", err)
+				log.Printf("close body error: %v", err)
+			}
+		}(response.Body)
+	}
+	return io.ReadAll(response.Body)
+}
+
+// DeleteHttpRequest 发送Delete请求
+func DeleteHttpRequest(url string, header map[string]string) ([]byte, error) {
+	request, err := http.NewRequest("DELETE", url, nil)
+	if nil != err {
+		return nil, err
+	}
+
+	request.Header.Add("accept", "application/json")
+	if header != nil {
+		for k, v := range header {
+			request.Header.Add(k, v)
+		}
+	}
+	httpClient := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response != nil {
+		defer func(Body io.ReadCloser) {
+			err = Body.Close()
+			if err != nil {
+				log.Printf("close body error: %v", err)
 			}
 		}(response.Body)
 	}